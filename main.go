@@ -1,22 +1,80 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"image"
 	"image/png"
+	"io/ioutil"
+	"net"
 	"os"
 	"runtime"
+	"strings"
+	"time"
 
 	"github.com/LeonLeibbrandt/raygun/raycore"
 )
 
 func main() {
-	scenefile := flag.String("scene", "", "Scene file")
-	numcpu := flag.Int("numcpu", 0, "Number Of cores to use")
-	flag.Parse()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "serve":
+			serve(os.Args[2:])
+			return
+		case "render":
+			render(os.Args[2:])
+			return
+		case "merge":
+			merge(os.Args[2:])
+			return
+		}
+	}
+	render(os.Args[1:])
+}
+
+// serve renders tiles for other raygun processes until it is killed. It reads any scene it
+// is sent and any file that scene names, without checking who sent it, so it listens on the
+// loopback interface only unless told otherwise, and must not be reachable from outside a
+// trusted network.
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:7070", "Address to listen on; do not expose it to untrusted networks")
+	numcpu := flags.Int("numcpu", 0, "Number Of cores to use")
+	flags.Parse(args)
+
+	if *numcpu == 0 {
+		*numcpu = runtime.NumCPU()
+	}
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stderr, "serving on", l.Addr())
+	if err := raycore.Serve(l, *numcpu); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func render(args []string) {
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	scenefile := flags.String("scene", "", "Scene file")
+	numcpu := flags.Int("numcpu", 0, "Number Of cores to use")
+	camera := flags.String("camera", "", "Named camera to render, or all to render every camera")
+	progress := flags.Bool("progress", false, "Show a progress bar on stderr")
+	samplemap := flags.Bool("samplemap", false, "Also write the number of samples per pixel taken by adaptive sampling")
+	crop := flags.String("crop", "", "Render only the window x0,y0,x1,y1 of the image")
+	croponly := flags.Bool("croponly", false, "Write only the crop window rather than the full size image")
+	workers := flags.String("workers", "", "Render on the raygun servers at host:port,... instead of locally")
+	timeout := flags.Duration("timeout", 0, "Longest to wait for a raygun server to render a tile, default 10m")
+	flags.Parse(args)
 
 	if *scenefile == "" {
-		fmt.Println("Usage: raygun --scene path/to/scene.txt --numcpu [Number of cores; defaults to all]")
+		fmt.Println("Usage: raygun [render] --scene path/to/scene.txt --numcpu [Number of cores; defaults to all] --camera [name|all] --workers [host:port,...]")
+		fmt.Println("       raygun serve --listen [host:port] --numcpu [Number of cores; defaults to all]")
+		fmt.Println("       raygun merge --out merged.png part.png ...")
 		os.Exit(0)
 	}
 	if *numcpu == 0 {
@@ -25,7 +83,22 @@ func main() {
 
 	rg, err := raycore.NewRayGun(*scenefile, *numcpu)
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for _, warning := range rg.Scene.Warnings {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *scenefile, warning)
+	}
+	if *crop != "" {
+		window, _, err := raycore.ParseCrop(strings.Split(*crop, ","))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		rg.Scene.Crop = window
+	}
+	if *croponly {
+		rg.Scene.CropOnly = true
 	}
 
 	/*
@@ -35,17 +108,116 @@ func main() {
 		file.Write(buf)
 		file.Close()
 	*/
-	rg.Render()
+	// the cameras to render, with an empty name for the scene's own camera
+	names := []string{*camera}
+	if *camera == "all" {
+		names = nil
+		for _, view := range rg.Scene.CameraList {
+			names = append(names, view.Name)
+		}
+		if len(names) == 0 {
+			names = []string{""}
+		}
+	}
 
-	output, err := os.Create(*scenefile + ".png")
-	if err != nil {
-		panic(err)
+	for _, name := range names {
+		if *camera != "" {
+			if err := rg.Scene.UseCamera(name); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+		if *progress {
+			rg.Progress = printProgress
+		}
+		rg.RemoteTimeout = *timeout
+		if *workers != "" {
+			text, err := ioutil.ReadFile(*scenefile)
+			if err == nil {
+				scene := &raycore.RemoteScene{Text: string(text), Camera: name}
+				err = rg.RenderRemote(context.Background(), scene, strings.Split(*workers, ","))
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		} else {
+			rg.Render()
+		}
+		if *progress {
+			fmt.Fprintln(os.Stderr)
+		}
+
+		filename := *scenefile + ".png"
+		if name != "" {
+			filename = *scenefile + "." + name + ".png"
+		}
+		if err := writePNG(filename, rg.Scene.Output()); err != nil {
+			panic(err)
+		}
+		if !rg.Scene.Crop.Empty() {
+			// record where the part goes for raygun merge
+			if err := raycore.WriteRegionFile(filename, rg.Scene.RenderRegion()); err != nil {
+				panic(err)
+			}
+		}
+		if *samplemap && rg.Scene.SampleCount != nil {
+			var samples image.Image = rg.Scene.SampleCount
+			if rg.Scene.CropOnly {
+				samples = rg.Scene.SampleCount.SubImage(rg.Scene.Region())
+			}
+			if err := writePNG(strings.TrimSuffix(filename, ".png")+".samples.png", samples); err != nil {
+				panic(err)
+			}
+		}
 	}
-	defer output.Close()
+}
 
-	err = png.Encode(output, rg.Scene.Image)
+// merge combines the images of partial renders, each with its .json sidecar file, into one.
+func merge(args []string) {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	out := flags.String("out", "merged.png", "Image to write")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		fmt.Println("Usage: raygun merge --out merged.png part.png ...")
+		os.Exit(0)
+	}
+	var parts []*raycore.Part
+	for _, filename := range flags.Args() {
+		part, err := raycore.LoadPart(filename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		parts = append(parts, part)
+	}
+	merged, err := raycore.MergeImages(parts)
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
+	if err := writePNG(*out, merged); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// printProgress draws a progress bar on stderr, overwriting the previous one.
+func printProgress(p raycore.Progress) {
+	const width = 40
+	filled := width * p.Done / p.Total
+	fmt.Fprintf(os.Stderr, "\r[%s%s] %3d%% %d rays %v elapsed %v left  ",
+		strings.Repeat("#", filled), strings.Repeat(".", width-filled),
+		100*p.Done/p.Total, p.Rays,
+		p.Elapsed.Round(time.Second), p.ETA.Round(time.Second))
+}
 
+func writePNG(filename string, img image.Image) error {
+	output, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	return png.Encode(output, img)
 }
@@ -0,0 +1,199 @@
+package raycore
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Background provides the color seen by rays that miss all the objects in the scene.
+type Background interface {
+	Init(scn *Scene)
+	GetColor(dir *Vector) Color
+}
+
+// SolidBackground is a single color in all directions.
+type SolidBackground struct {
+	Color Color
+}
+
+func (b *SolidBackground) Init(scn *Scene) {
+}
+
+func (b *SolidBackground) GetColor(dir *Vector) Color {
+	return b.Color
+}
+
+// GradientBackground blends from the Horizon color to the Zenith color going up along the
+// scene CameraUp. Below the horizon it stays the Horizon color.
+type GradientBackground struct {
+	Zenith  Color
+	Horizon Color
+	Up      *Vector `json:"-"`
+}
+
+func (b *GradientBackground) Init(scn *Scene) {
+	b.Up = scn.CameraUp.Normalize()
+}
+
+func (b *GradientBackground) GetColor(dir *Vector) Color {
+	t := math.Max(0.0, dir.Normalize().Dot(b.Up))
+	return b.Horizon.Mul(1.0 - t).Add(b.Zenith.Mul(t))
+}
+
+// EnvironmentMap is an equirectangular (latitude/longitude) image surrounding the scene, with
+// the top of the image along the scene CameraUp. If Samples is larger than zero the map also
+// lights the scene, using that number of importance sampled directions per shading point.
+type EnvironmentMap struct {
+	ImageName string
+	Intensity float64
+	Samples   int
+	Width     int     `json:"-"`
+	Height    int     `json:"-"`
+	Pix       []Color `json:"-"`
+	Up        *Vector `json:"-"`
+	X         *Vector `json:"-"`
+	Y         *Vector `json:"-"`
+	rowCdf    [][]float64
+	marginal  []float64
+	total     float64
+}
+
+// NewEnvironmentMap loads an equirectangular environment from an image file, such as a
+// Radiance .hdr file.
+func NewEnvironmentMap(filename string, intensity float64, samples int) (*EnvironmentMap, error) {
+	img, err := DecodeImageFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	e := &EnvironmentMap{
+		ImageName: filename,
+		Intensity: intensity,
+		Samples:   samples,
+		Width:     bounds.Dx(),
+		Height:    bounds.Dy(),
+		Pix:       make([]Color, bounds.Dx()*bounds.Dy()),
+	}
+	for y := 0; y < e.Height; y++ {
+		for x := 0; x < e.Width; x++ {
+			var c Color
+			if hdr, ok := img.(*HDRImage); ok {
+				c = hdr.ColorAt(x, y)
+			} else {
+				r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+				c = Color{float64(r) / 0xffff, float64(g) / 0xffff, float64(b) / 0xffff}
+			}
+			e.Pix[y*e.Width+x] = c.Mul(intensity)
+		}
+	}
+	e.buildDistribution()
+	return e, nil
+}
+
+// buildDistribution sets up the cumulative distributions used to pick directions in
+// proportion to their brightness.
+func (e *EnvironmentMap) buildDistribution() {
+	e.rowCdf = make([][]float64, e.Height)
+	e.marginal = make([]float64, e.Height)
+	sum := 0.0
+	for y := 0; y < e.Height; y++ {
+		sinTheta := math.Sin(math.Pi * (float64(y) + 0.5) / float64(e.Height))
+		cdf := make([]float64, e.Width)
+		row := 0.0
+		for x := 0; x < e.Width; x++ {
+			c := e.Pix[y*e.Width+x]
+			row += c.Luminance() * sinTheta
+			cdf[x] = row
+		}
+		e.rowCdf[y] = cdf
+		sum += row
+		e.marginal[y] = sum
+	}
+	e.total = sum
+}
+
+func (e *EnvironmentMap) Init(scn *Scene) {
+	e.Up = scn.CameraUp.Normalize()
+	e.Y, e.X = orthonormalBasis(e.Up)
+}
+
+func (e *EnvironmentMap) GetColor(dir *Vector) Color {
+	x, y := e.pixel(dir.Normalize())
+	return e.Pix[y*e.Width+x]
+}
+
+// pixel returns the image pixel seen in direction dir.
+func (e *EnvironmentMap) pixel(dir *Vector) (int, int) {
+	theta := math.Acos(math.Max(-1.0, math.Min(1.0, dir.Dot(e.Up))))
+	phi := math.Atan2(dir.Dot(e.Y), dir.Dot(e.X))
+	if phi < 0.0 {
+		phi += 2 * math.Pi
+	}
+	x := int(phi / (2 * math.Pi) * float64(e.Width))
+	y := int(theta / math.Pi * float64(e.Height))
+	return clampInt(x, 0, e.Width-1), clampInt(y, 0, e.Height-1)
+}
+
+// Sample picks a direction using the uniform random numbers u1 and u2, with a probability
+// in proportion to the brightness of the map. It returns the direction, the color seen in
+// that direction and the probability density of having picked it per unit solid angle.
+func (e *EnvironmentMap) Sample(u1, u2 float64) (*Vector, Color, float64) {
+	if e.total <= 0.0 {
+		return &Vector{0, 0, 1}, Color{}, 0.0
+	}
+	y := sort.SearchFloat64s(e.marginal, u2*e.total)
+	y = clampInt(y, 0, e.Height-1)
+	cdf := e.rowCdf[y]
+	x := sort.SearchFloat64s(cdf, u1*cdf[e.Width-1])
+	x = clampInt(x, 0, e.Width-1)
+
+	theta := math.Pi * (float64(y) + 0.5) / float64(e.Height)
+	phi := 2 * math.Pi * (float64(x) + 0.5) / float64(e.Width)
+	sinTheta := math.Sin(theta)
+	dir := e.X.Mul(sinTheta * math.Cos(phi)).Add(e.Y.Mul(sinTheta * math.Sin(phi))).Add(e.Up.Mul(math.Cos(theta)))
+
+	c := e.Pix[y*e.Width+x]
+	pdf := c.Luminance() * sinTheta / e.total * float64(e.Width*e.Height)
+	if sinTheta == 0.0 {
+		return dir, c, 0.0
+	}
+	return dir, c, pdf / (2 * math.Pi * math.Pi * sinTheta)
+}
+
+// ParseBackground creates a background from a scene file background line:
+//
+//	r g b
+//	color r g b
+//	gradient zenith_r zenith_g zenith_b horizon_r horizon_g horizon_b
+//	image file.png|file.hdr [intensity] [samples]
+func ParseBackground(line []string) (Background, error) {
+	switch line[0] {
+	case "color":
+		return &SolidBackground{ParseColor(line[1:4])}, nil
+	case "gradient":
+		return &GradientBackground{Zenith: ParseColor(line[1:4]), Horizon: ParseColor(line[4:7])}, nil
+	case "image":
+		intensity := 1.0
+		samples := 0
+		if len(line) > 2 {
+			intensity, _ = strconv.ParseFloat(line[2], 64)
+		}
+		if len(line) > 3 {
+			samples, _ = strconv.Atoi(line[3])
+		}
+		return NewEnvironmentMap(line[1], intensity, samples)
+	}
+	return &SolidBackground{ParseColor(line[0:3])}, nil
+}
+
+func clampInt(i, min, max int) int {
+	if i < min {
+		return min
+	}
+	if i > max {
+		return max
+	}
+	return i
+}
@@ -0,0 +1,378 @@
+package raycore
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+)
+
+// Camera generates the rays that leave the camera through the image.
+// GetRay returns the ray through the point x,y of the image, in pixels from its top left
+// corner, or nil if the point is outside the projection. u1 and u2 are uniform random numbers
+// used to sample the lens. The ray carries the footprint of a single pixel.
+type Camera interface {
+	Init(scn *Scene)
+	GetRay(x, y, u1, u2 float64) *Ray
+}
+
+// cameraBasis is the position and orientation of the camera in the scene, with right and
+// down along the x and y axes of the image.
+type cameraBasis struct {
+	position *Vector
+	forward  *Vector
+	right    *Vector
+	down     *Vector
+	width    float64
+	height   float64
+}
+
+func (b *cameraBasis) init(scn *Scene) {
+	b.position = scn.CameraPos
+	b.forward = scn.Look.Normalize()
+	b.right = scn.Vhor
+	b.down = scn.Vver
+	b.width = float64(scn.ImgWidth)
+	b.height = float64(scn.ImgHeight)
+}
+
+// PerspectiveCamera is a pinhole camera with a horizontal field of view of VisionField. With
+// an aperture it is a thin lens that focuses at FocusDistance.
+type PerspectiveCamera struct {
+	cameraBasis
+	corner   *Vector
+	aperture float64
+	focus    float64
+	spread   float64
+}
+
+func (c *PerspectiveCamera) Init(scn *Scene) {
+	c.init(scn)
+	fl := c.width / (2 * math.Tan((0.5*scn.VisionField)*PI_180))
+	c.corner = c.forward.Mul(fl).Sub(c.right.Mul(0.5 * c.width)).Sub(c.down.Mul(0.5 * c.height))
+	c.aperture = scn.Aperture
+	c.focus = scn.FocusDistance
+	if c.focus <= 0.0 {
+		c.focus = scn.Look.Module()
+	}
+	c.spread = scn.VisionField * PI_180 / c.width
+}
+
+// GetRay starts the ray at a point on the lens, passing through the point where the pinhole
+// ray meets the plane in focus.
+func (c *PerspectiveCamera) GetRay(x, y, u1, u2 float64) *Ray {
+	dir := c.corner.Add(c.right.Mul(x)).Add(c.down.Mul(y)).Normalize()
+	origin := c.position
+	if c.aperture > 0.0 {
+		focusPoint := c.position.Add(dir.Mul(c.focus / dir.Dot(c.forward)))
+		rad := 0.5 * c.aperture * math.Sqrt(u1)
+		phi := 2.0 * math.Pi * u2
+		origin = origin.Add(c.right.Mul(rad * math.Cos(phi))).Add(c.down.Mul(rad * math.Sin(phi)))
+		dir = focusPoint.Sub(origin).Normalize()
+	}
+	r := NewRay(origin, dir)
+	r.spread = c.spread
+	return r
+}
+
+// OrthographicCamera sends parallel rays from a rectangle Width scene units wide. A Width of
+// zero is as wide as the perspective view at the point the camera looks at.
+type OrthographicCamera struct {
+	cameraBasis
+	Width float64
+	pixel float64
+}
+
+func (c *OrthographicCamera) Init(scn *Scene) {
+	c.init(scn)
+	width := c.Width
+	if width <= 0.0 {
+		width = 2.0 * scn.Look.Module() * math.Tan((0.5*scn.VisionField)*PI_180)
+	}
+	c.pixel = width / c.width
+}
+
+func (c *OrthographicCamera) GetRay(x, y, u1, u2 float64) *Ray {
+	origin := c.position.Add(c.right.Mul((x - 0.5*c.width) * c.pixel)).Add(c.down.Mul((y - 0.5*c.height) * c.pixel))
+	r := NewRay(origin, c.forward)
+	r.cone = c.pixel
+	return r
+}
+
+// EquirectangularCamera sees all around, with longitude across the image and latitude down
+// it. The center of the image is the direction the camera looks in.
+type EquirectangularCamera struct {
+	cameraBasis
+}
+
+func (c *EquirectangularCamera) Init(scn *Scene) {
+	c.init(scn)
+}
+
+func (c *EquirectangularCamera) GetRay(x, y, u1, u2 float64) *Ray {
+	phi := (x/c.width - 0.5) * 2.0 * math.Pi
+	theta := (0.5 - y/c.height) * math.Pi
+	dir := c.forward.Mul(math.Cos(theta) * math.Cos(phi)).
+		Add(c.right.Mul(math.Cos(theta) * math.Sin(phi))).
+		Sub(c.down.Mul(math.Sin(theta)))
+	r := NewRay(c.position, dir)
+	r.spread = 2.0 * math.Pi / c.width
+	return r
+}
+
+// FisheyeCamera is an equidistant fisheye that fits a circle FieldOfView degrees across in the
+// image, 180 degrees if it is zero.
+type FisheyeCamera struct {
+	cameraBasis
+	FieldOfView float64
+	radius      float64
+	fov         float64
+}
+
+func (c *FisheyeCamera) Init(scn *Scene) {
+	c.init(scn)
+	c.fov = c.FieldOfView
+	if c.fov <= 0.0 {
+		c.fov = 180.0
+	}
+	c.fov *= PI_180
+	c.radius = 0.5 * math.Min(c.width, c.height)
+}
+
+func (c *FisheyeCamera) GetRay(x, y, u1, u2 float64) *Ray {
+	dx := (x - 0.5*c.width) / c.radius
+	dy := (y - 0.5*c.height) / c.radius
+	dist := math.Sqrt(dx*dx + dy*dy)
+	if dist > 1.0 {
+		return nil
+	}
+	dir := c.forward
+	if dist > 0.0 {
+		angle := 0.5 * c.fov * dist
+		side := c.right.Mul(dx / dist).Add(c.down.Mul(dy / dist))
+		dir = c.forward.Mul(math.Cos(angle)).Add(side.Mul(math.Sin(angle)))
+	}
+	r := NewRay(c.position, dir)
+	r.spread = 0.5 * c.fov / c.radius
+	return r
+}
+
+// CubemapCamera renders the six faces of a cube around the camera, in two rows of three:
+// right, left and up, then down, front and back.
+type CubemapCamera struct {
+	cameraBasis
+	faces [6][3]*Vector
+}
+
+func (c *CubemapCamera) Init(scn *Scene) {
+	c.init(scn)
+	up := c.down.Mul(-1.0)
+	left := c.right.Mul(-1.0)
+	back := c.forward.Mul(-1.0)
+	// the direction each face looks in, followed by its right and down
+	c.faces = [6][3]*Vector{
+		{c.right, back, c.down},
+		{left, c.forward, c.down},
+		{up, c.right, c.forward},
+		{c.down, c.right, back},
+		{c.forward, c.right, c.down},
+		{back, left, c.down},
+	}
+}
+
+func (c *CubemapCamera) GetRay(x, y, u1, u2 float64) *Ray {
+	faceWidth := c.width / 3.0
+	faceHeight := c.height / 2.0
+	col := clampInt(int(x/faceWidth), 0, 2)
+	row := clampInt(int(y/faceHeight), 0, 1)
+	s := 2.0*(x-float64(col)*faceWidth)/faceWidth - 1.0
+	t := 2.0*(y-float64(row)*faceHeight)/faceHeight - 1.0
+	face := c.faces[row*3+col]
+	dir := face[0].Add(face[1].Mul(s)).Add(face[2].Mul(t)).Normalize()
+	r := NewRay(c.position, dir)
+	r.spread = 0.5 * math.Pi / faceWidth
+	return r
+}
+
+// ParseProjection creates a camera from the values following projection on a scene file line:
+// perspective | orthographic [width] | equirectangular | fisheye [fov] | cubemap
+func ParseProjection(line []string) (Camera, error) {
+	param := 0.0
+	if len(line) > 1 {
+		param, _ = strconv.ParseFloat(line[1], 64)
+	}
+	switch line[0] {
+	case "perspective":
+		return &PerspectiveCamera{}, nil
+	case "orthographic":
+		return &OrthographicCamera{Width: param}, nil
+	case "equirectangular":
+		return &EquirectangularCamera{}, nil
+	case "fisheye":
+		return &FisheyeCamera{FieldOfView: param}, nil
+	case "cubemap":
+		return &CubemapCamera{}, nil
+	}
+	return nil, fmt.Errorf("unknown projection %s", line[0])
+}
+
+// View is a named camera of a scene, set up by a camera block in the scene file. Fields that
+// are not set keep the values of the scene's own camera.
+type View struct {
+	Name          string
+	CameraPos     *Vector
+	CameraLook    *Vector
+	CameraUp      *Vector
+	VisionField   float64
+	Aperture      float64
+	FocusDistance float64
+	Camera        Camera `json:"-"`
+	FrameDir      *Vector
+	FrameMargin   float64
+}
+
+// parse sets the view from a camera line of a scene file and reports whether the keyword
+// was one of the camera's.
+func (v *View) parse(word string, data []string) (bool, error) {
+	switch word {
+	case "cameraPos":
+		v.CameraPos = ParseVector(data)
+	case "cameraLook":
+		v.CameraLook = ParseVector(data)
+	case "cameraUp":
+		v.CameraUp = ParseVector(data)
+	case "vision":
+		v.VisionField, _ = strconv.ParseFloat(data[0], 64)
+	case "aperture":
+		v.Aperture, _ = strconv.ParseFloat(data[0], 64)
+	case "focusDistance":
+		v.FocusDistance, _ = strconv.ParseFloat(data[0], 64)
+	case "projection":
+		camera, err := ParseProjection(data)
+		if err != nil {
+			return true, err
+		}
+		v.Camera = camera
+	case "autoframe":
+		v.FrameDir, v.FrameMargin = parseAutoFrame(data)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// UseCamera switches the scene to the named view, or back to the scene's own camera if name
+// is empty, and gives it a new image to render into.
+func (scn *Scene) UseCamera(name string) error {
+	var view *View
+	if name != "" {
+		for _, v := range scn.CameraList {
+			if v.Name == name {
+				view = v
+			}
+		}
+		if view == nil {
+			return fmt.Errorf("unknown camera %s", name)
+		}
+	}
+
+	if scn.ownView == nil {
+		scn.ownView = &View{
+			CameraPos:     scn.CameraPos,
+			CameraLook:    scn.CameraLook,
+			CameraUp:      scn.CameraUp,
+			VisionField:   scn.VisionField,
+			Aperture:      scn.Aperture,
+			FocusDistance: scn.FocusDistance,
+			Camera:        scn.Camera,
+		}
+	}
+	own := scn.ownView
+	scn.CameraPos, scn.CameraLook, scn.CameraUp = own.CameraPos, own.CameraLook, own.CameraUp
+	scn.VisionField, scn.Aperture, scn.FocusDistance = own.VisionField, own.Aperture, own.FocusDistance
+	scn.Camera = own.Camera
+
+	if view != nil {
+		if view.CameraPos != nil {
+			scn.CameraPos = view.CameraPos
+		}
+		if view.CameraLook != nil {
+			scn.CameraLook = view.CameraLook
+		}
+		if view.CameraUp != nil {
+			scn.CameraUp = view.CameraUp
+		}
+		if view.VisionField != 0.0 {
+			scn.VisionField = view.VisionField
+		}
+		if view.Aperture != 0.0 {
+			scn.Aperture = view.Aperture
+		}
+		if view.FocusDistance != 0.0 {
+			scn.FocusDistance = view.FocusDistance
+		}
+		if view.Camera != nil {
+			scn.Camera = view.Camera
+		}
+	}
+
+	scn.Image = image.NewRGBA(image.Rect(0, 0, scn.ImgWidth, scn.ImgHeight))
+	var err error
+	if view != nil && view.FrameDir != nil {
+		err = scn.AutoFrame(view.FrameDir, view.FrameMargin)
+	} else {
+		err = scn.initCamera()
+	}
+	if err != nil && name != "" {
+		return fmt.Errorf("camera %s: %v", name, err)
+	}
+	return err
+}
+
+// parseAutoFrame parses the values following autoframe on a scene file line:
+// dx dy dz [margin]
+func parseAutoFrame(line []string) (*Vector, float64) {
+	margin := 0.0
+	if len(line) > 3 {
+		margin, _ = strconv.ParseFloat(line[3], 64)
+	}
+	return ParseVector(line[0:3]), margin
+}
+
+// AutoFrame places the camera on the side of the scene in the direction dir from its center,
+// looking at the center, at the distance where the bounding sphere of the scene fills the
+// image. margin is the fraction of space added around the sphere, and sets the width of an
+// orthographic camera.
+func (scn *Scene) AutoFrame(dir *Vector, margin float64) error {
+	center, radius, ok := scn.BoundingSphere()
+	if !ok {
+		return errors.New("autoframe needs a scene with bounded objects")
+	}
+	dir = dir.Normalize()
+	radius *= 1.0 + margin
+
+	// the sphere must fit in the narrower of the two fields of view
+	halfAngle := 0.5 * scn.VisionField * PI_180
+	if scn.ImgHeight < scn.ImgWidth {
+		halfAngle = math.Atan(math.Tan(halfAngle) * float64(scn.ImgHeight) / float64(scn.ImgWidth))
+	}
+	scn.CameraLook = center
+	scn.CameraPos = center.Add(dir.Mul(radius / math.Sin(halfAngle)))
+
+	if scn.CameraUp == nil {
+		scn.CameraUp = &Vector{0, 0, 1}
+	}
+	if math.Abs(scn.CameraUp.Normalize().Dot(dir)) > 0.999 {
+		// looking along the up vector, so the image needs another up
+		scn.CameraUp, _ = orthonormalBasis(dir)
+	}
+
+	if ortho, ok := scn.Camera.(*OrthographicCamera); ok {
+		// a copy, as the camera may be shared with the scene's own view or other views
+		o := *ortho
+		o.Width = 2.0 * radius * math.Max(1.0, float64(scn.ImgWidth)/float64(scn.ImgHeight))
+		scn.Camera = &o
+	}
+	return scn.initCamera()
+}
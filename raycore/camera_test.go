@@ -0,0 +1,160 @@
+package raycore
+
+import (
+	"context"
+	"math"
+	"testing"
+)
+
+func TestNamedCamerasOnly(t *testing.T) {
+	scn, err := ParseScene(`
+camera front
+cameraPos 0 -10 0
+cameraLook 0 0 0
+camera top
+cameraPos 0 0 10
+cameraLook 0 0 0
+cameraUp 0 1 0
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *scn.CameraPos != (Vector{0, -10, 0}) || *scn.CameraUp != (Vector{0, 0, 1}) {
+		t.Errorf("camera at %v up %v, want the first named camera with z up", scn.CameraPos, scn.CameraUp)
+	}
+	for _, view := range scn.CameraList {
+		if err := scn.UseCamera(view.Name); err != nil {
+			t.Errorf("UseCamera(%s): %v", view.Name, err)
+		}
+	}
+	if *scn.CameraPos != (Vector{0, 0, 10}) {
+		t.Errorf("camera at %v after switching to top", scn.CameraPos)
+	}
+}
+
+func TestMissingCamera(t *testing.T) {
+	if _, err := ParseScene("size 64 48\n"); err == nil {
+		t.Error("scene without a camera loaded")
+	}
+
+	scn, err := ParseScene("camera partial\nvision 30\ncamera full\ncameraPos 0 -10 0\ncameraLook 0 0 0\n")
+	if err == nil {
+		t.Fatalf("scene whose first camera has no position loaded with camera at %v", scn.CameraPos)
+	}
+
+	scn, err = ParseScene(testCamera + "camera partial\nvision 30\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a view without a position keeps the scene's own
+	if err := scn.UseCamera("partial"); err != nil {
+		t.Error(err)
+	}
+	if err := scn.UseCamera("missing"); err == nil {
+		t.Error("UseCamera of an unknown camera returned no error")
+	}
+
+	rg, _ := NewRayGunFromScene(&Scene{ImgWidth: 4, ImgHeight: 4}, 1)
+	if err := rg.RenderContext(context.Background()); err == nil {
+		t.Error("rendering a scene without a camera returned no error")
+	}
+}
+
+func TestProjections(t *testing.T) {
+	// directions and offsets are given along forward, right and up of the camera, and the
+	// camera is at 0,-10,0
+	type basis struct{ f, r, u float64 }
+	forward, right, up := basis{1, 0, 0}, basis{0, 1, 0}, basis{0, 0, 1}
+	neg := func(b basis) basis { return basis{-b.f, -b.r, -b.u} }
+	h := math.Sqrt(0.5)
+	tests := []struct {
+		projection string
+		x, y       float64
+		dir        basis
+		offset     basis // of the ray origin from the camera
+	}{
+		{"perspective", 32, 16, forward, basis{}},
+		{"orthographic 4", 32, 16, forward, basis{}},
+		{"orthographic 4", 0, 16, forward, basis{0, -2, 0}},
+		{"orthographic 4", 32, 0, forward, basis{0, 0, 1}},
+		{"equirectangular", 32, 16, forward, basis{}},
+		{"equirectangular", 48, 16, right, basis{}},
+		{"equirectangular", 16, 16, neg(right), basis{}},
+		{"equirectangular", 0, 16, neg(forward), basis{}},
+		{"equirectangular", 20, 0, up, basis{}},
+		{"equirectangular", 40, 32, neg(up), basis{}},
+		{"fisheye", 32, 16, forward, basis{}},
+		{"fisheye", 48, 16, right, basis{}},
+		{"fisheye", 32, 0, up, basis{}},
+		{"fisheye 90", 48, 16, basis{h, h, 0}, basis{}},
+		// the face centers of the two rows of three faces
+		{"cubemap", 64.0 / 6, 8, right, basis{}},
+		{"cubemap", 64.0 / 2, 8, neg(right), basis{}},
+		{"cubemap", 5 * 64.0 / 6, 8, up, basis{}},
+		{"cubemap", 64.0 / 6, 24, neg(up), basis{}},
+		{"cubemap", 64.0 / 2, 24, forward, basis{}},
+		{"cubemap", 5 * 64.0 / 6, 24, neg(forward), basis{}},
+	}
+	for _, tt := range tests {
+		scn, err := ParseScene(testCamera + "size 64 32\nprojection " + tt.projection + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		world := func(b basis) *Vector {
+			return scn.Look.Normalize().Mul(b.f).Add(scn.Vhor.Mul(b.r)).Sub(scn.Vver.Mul(b.u))
+		}
+		r := scn.Camera.GetRay(tt.x, tt.y, 0.5, 0.5)
+		if r == nil {
+			t.Errorf("%s at %v,%v: no ray", tt.projection, tt.x, tt.y)
+			continue
+		}
+		dir, origin := world(tt.dir), scn.CameraPos.Add(world(tt.offset))
+		if r.direction.Normalize().Sub(dir).Module() > 1e-6 || r.origin.Sub(origin).Module() > 1e-6 {
+			t.Errorf("%s at %v,%v: ray from %v along %v, want from %v along %v",
+				tt.projection, tt.x, tt.y, r.origin, r.direction, origin, dir)
+		}
+	}
+
+	// the fisheye sees nothing outside its circle
+	scn, err := ParseScene(testCamera + "size 64 32\nprojection fisheye\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range [][2]float64{{0, 0}, {10, 16}, {60, 30}, {32, 33}} {
+		if r := scn.Camera.GetRay(p[0], p[1], 0.5, 0.5); r != nil {
+			t.Errorf("fisheye ray at %v outside the circle", p)
+		}
+	}
+}
+
+func TestAutoFrameKeepsOwnCamera(t *testing.T) {
+	scn, err := ParseScene(testCamera + `projection orthographic 3
+material 1 0 0 1.6 0 0 0 0 0
+group ball 0 0 0 true
+sphere 0 0 0 0 2
+camera fit
+autoframe 1 0 0 0.1
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	width := func() float64 {
+		return scn.Camera.(*OrthographicCamera).Width
+	}
+	// the ball with a margin of 0.1 is 4.4 across, fitted to the height of the image
+	want := 4.4 * float64(scn.ImgWidth) / float64(scn.ImgHeight)
+	for i := 0; i < 2; i++ {
+		if err := scn.UseCamera("fit"); err != nil {
+			t.Fatal(err)
+		}
+		if w := width(); math.Abs(w-want) > 1e-9 {
+			t.Errorf("autoframed width %v, want %v", w, want)
+		}
+		if err := scn.UseCamera(""); err != nil {
+			t.Fatal(err)
+		}
+		if w := width(); w != 3 {
+			t.Errorf("width %v after switching back to the scene's own camera, want 3", w)
+		}
+	}
+}
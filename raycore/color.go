@@ -20,6 +20,16 @@ func (c Color) Mul(f float64) Color {
 	return Color{c.R * f, c.G * f, c.B * f}
 }
 
+// MulColor multiplies two colors component by component.
+func (c Color) MulColor(u Color) Color {
+	return Color{c.R * u.R, c.G * u.G, c.B * u.B}
+}
+
+// Luminance returns the perceived brightness of the color.
+func (c Color) Luminance() float64 {
+	return 0.2126*c.R + 0.7152*c.G + 0.0722*c.B
+}
+
 // ToPixel return the standard color from a Color struct.
 func (c Color) ToPixel() color.RGBA {
 	c.R = math.Max(0.0, math.Min(c.R*255.0, 255.0))
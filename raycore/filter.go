@@ -0,0 +1,222 @@
+package raycore
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"sync"
+)
+
+// Filter weighs a sample by its offset dx,dy in pixels from the center of a pixel. Samples
+// further than the Radius from a pixel center are not used by that pixel.
+type Filter interface {
+	Radius() float64
+	Weight(dx, dy float64) float64
+}
+
+// BoxFilter weighs all samples within the radius the same. With a radius of half a pixel it
+// averages the samples inside each pixel.
+type BoxFilter struct {
+	R float64
+}
+
+func (f *BoxFilter) Radius() float64 {
+	return f.R
+}
+
+func (f *BoxFilter) Weight(dx, dy float64) float64 {
+	if dx < -f.R || dx >= f.R || dy < -f.R || dy >= f.R {
+		return 0.0
+	}
+	return 1.0
+}
+
+// TentFilter falls off linearly to zero at the radius.
+type TentFilter struct {
+	R float64
+}
+
+func (f *TentFilter) Radius() float64 {
+	return f.R
+}
+
+func (f *TentFilter) Weight(dx, dy float64) float64 {
+	return math.Max(0.0, f.R-math.Abs(dx)) * math.Max(0.0, f.R-math.Abs(dy))
+}
+
+// GaussianFilter is a Gaussian bell of sharpness Alpha, lowered so that it reaches zero at
+// the radius.
+type GaussianFilter struct {
+	R     float64
+	Alpha float64
+}
+
+func (f *GaussianFilter) Radius() float64 {
+	return f.R
+}
+
+func (f *GaussianFilter) Weight(dx, dy float64) float64 {
+	edge := math.Exp(-f.Alpha * f.R * f.R)
+	gauss := func(d float64) float64 {
+		return math.Max(0.0, math.Exp(-f.Alpha*d*d)-edge)
+	}
+	return gauss(dx) * gauss(dy)
+}
+
+// MitchellFilter is the Mitchell-Netravali cubic with B and C of 1/3, which trades ringing
+// for blur. Its negative lobes sharpen edges.
+type MitchellFilter struct {
+	R float64
+}
+
+func (f *MitchellFilter) Radius() float64 {
+	return f.R
+}
+
+func (f *MitchellFilter) Weight(dx, dy float64) float64 {
+	return f.mitchell(dx) * f.mitchell(dy)
+}
+
+func (f *MitchellFilter) mitchell(d float64) float64 {
+	const b, c = 1.0 / 3.0, 1.0 / 3.0
+	x := math.Abs(2.0 * d / f.R)
+	switch {
+	case x < 1.0:
+		return ((12-9*b-6*c)*x*x*x + (-18+12*b+6*c)*x*x + (6 - 2*b)) / 6.0
+	case x < 2.0:
+		return ((-b-6*c)*x*x*x + (6*b+30*c)*x*x + (-12*b-48*c)*x + (8*b + 24*c)) / 6.0
+	}
+	return 0.0
+}
+
+// LanczosFilter is a sinc windowed by a wider sinc that reaches zero at the radius.
+type LanczosFilter struct {
+	R float64
+}
+
+func (f *LanczosFilter) Radius() float64 {
+	return f.R
+}
+
+func (f *LanczosFilter) Weight(dx, dy float64) float64 {
+	return f.lanczos(dx) * f.lanczos(dy)
+}
+
+func (f *LanczosFilter) lanczos(d float64) float64 {
+	d = math.Abs(d)
+	if d >= f.R {
+		return 0.0
+	}
+	return sinc(d) * sinc(d/f.R)
+}
+
+func sinc(x float64) float64 {
+	if x < 1e-5 {
+		return 1.0
+	}
+	x *= math.Pi
+	return math.Sin(x) / x
+}
+
+// ParseFilter creates a filter from the values following filter on a scene file line:
+// box | tent | gaussian | mitchell | lanczos [radius] [gaussian alpha]
+func ParseFilter(line []string) (Filter, error) {
+	radius := 0.0
+	if len(line) > 1 {
+		radius, _ = strconv.ParseFloat(line[1], 64)
+	}
+	orDefault := func(value, def float64) float64 {
+		if value <= 0.0 {
+			return def
+		}
+		return value
+	}
+	switch line[0] {
+	case "box":
+		return &BoxFilter{R: orDefault(radius, 0.5)}, nil
+	case "tent":
+		return &TentFilter{R: orDefault(radius, 1.0)}, nil
+	case "gaussian":
+		alpha := 0.0
+		if len(line) > 2 {
+			alpha, _ = strconv.ParseFloat(line[2], 64)
+		}
+		return &GaussianFilter{R: orDefault(radius, 1.5), Alpha: orDefault(alpha, 2.0)}, nil
+	case "mitchell":
+		return &MitchellFilter{R: orDefault(radius, 2.0)}, nil
+	case "lanczos":
+		return &LanczosFilter{R: orDefault(radius, 3.0)}, nil
+	}
+	return nil, fmt.Errorf("unknown filter %s", line[0])
+}
+
+// Framebuffer sums the filtered samples of the pixels in Rect of an image in floating point.
+// Rows are locked separately so that workers can add samples that spread into each other's
+// rows.
+type Framebuffer struct {
+	Rect   image.Rectangle
+	sum    []Color
+	weight []float64
+	rows   []sync.Mutex
+}
+
+// NewFramebuffer creates an empty framebuffer for the pixels in rect.
+func NewFramebuffer(rect image.Rectangle) *Framebuffer {
+	return &Framebuffer{
+		Rect:   rect,
+		sum:    make([]Color, rect.Dx()*rect.Dy()),
+		weight: make([]float64, rect.Dx()*rect.Dy()),
+		rows:   make([]sync.Mutex, rect.Dy()),
+	}
+}
+
+func (fb *Framebuffer) index(x, y int) int {
+	return (y-fb.Rect.Min.Y)*fb.Rect.Dx() + x - fb.Rect.Min.X
+}
+
+// AddSample adds the color c of a sample at x,y, in pixels from the top left of the image, to
+// every pixel of the framebuffer within the radius of the filter.
+func (fb *Framebuffer) AddSample(x, y float64, c Color, f Filter) {
+	radius := f.Radius()
+	x0 := maxInt(fb.Rect.Min.X, int(math.Ceil(x-radius-0.5)))
+	x1 := minInt(fb.Rect.Max.X-1, int(math.Floor(x+radius-0.5)))
+	y0 := maxInt(fb.Rect.Min.Y, int(math.Ceil(y-radius-0.5)))
+	y1 := minInt(fb.Rect.Max.Y-1, int(math.Floor(y+radius-0.5)))
+	for py := y0; py <= y1; py++ {
+		row := &fb.rows[py-fb.Rect.Min.Y]
+		row.Lock()
+		for px := x0; px <= x1; px++ {
+			w := f.Weight(x-float64(px)-0.5, y-float64(py)-0.5)
+			if w == 0.0 {
+				continue
+			}
+			i := fb.index(px, py)
+			fb.sum[i] = fb.sum[i].Add(c.Mul(w))
+			fb.weight[i] += w
+		}
+		row.Unlock()
+	}
+}
+
+// Pixel returns the filtered color of the pixel x,y.
+func (fb *Framebuffer) Pixel(x, y int) Color {
+	row := &fb.rows[y-fb.Rect.Min.Y]
+	row.Lock()
+	defer row.Unlock()
+	i := fb.index(x, y)
+	if fb.weight[i] == 0.0 {
+		return Color{}
+	}
+	return fb.sum[i].Mul(1.0 / fb.weight[i])
+}
+
+// Resolve writes the filtered colors of the pixels in rect to img.
+func (fb *Framebuffer) Resolve(img *image.RGBA, rect image.Rectangle) {
+	rect = rect.Intersect(fb.Rect)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			img.SetRGBA(x, y, fb.Pixel(x, y).ToPixel())
+		}
+	}
+}
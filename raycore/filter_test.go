@@ -0,0 +1,118 @@
+package raycore
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestFilterWeights(t *testing.T) {
+	const b = 1.0 / 3.0
+	tests := []struct {
+		name   string
+		filter Filter
+		dx, dy float64
+		want   float64
+	}{
+		{"box center", &BoxFilter{R: 0.5}, 0, 0, 1},
+		{"box inside", &BoxFilter{R: 0.5}, -0.5, 0.49, 1},
+		{"box edge", &BoxFilter{R: 0.5}, 0.5, 0, 0},
+		{"tent center", &TentFilter{R: 1}, 0, 0, 1},
+		{"tent half", &TentFilter{R: 1}, 0.5, 0, 0.5},
+		{"tent diagonal", &TentFilter{R: 1}, 0.5, -0.5, 0.25},
+		{"tent edge", &TentFilter{R: 1}, 1, 0, 0},
+		{"gaussian center", &GaussianFilter{R: 1.5, Alpha: 2}, 0, 0, math.Pow(1-math.Exp(-2*1.5*1.5), 2)},
+		{"gaussian edge", &GaussianFilter{R: 1.5, Alpha: 2}, 1.5, 0, 0},
+		{"mitchell center", &MitchellFilter{R: 2}, 0, 0, (6 - 2*b) / 6 * (6 - 2*b) / 6},
+		{"mitchell edge", &MitchellFilter{R: 2}, 2, 0, 0},
+		{"lanczos center", &LanczosFilter{R: 3}, 0, 0, 1},
+		{"lanczos zero", &LanczosFilter{R: 3}, 1, 0, 0},
+		{"lanczos edge", &LanczosFilter{R: 3}, 3, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.Weight(tt.dx, tt.dy); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: Weight(%v, %v) = %v, want %v", tt.name, tt.dx, tt.dy, got, tt.want)
+		}
+	}
+
+	// the negative lobes sharpen
+	if w := (&MitchellFilter{R: 2}).Weight(1.5, 0); w >= 0 {
+		t.Errorf("mitchell lobe weight %v, want negative", w)
+	}
+	if w := (&LanczosFilter{R: 3}).Weight(1.5, 0); w >= 0 {
+		t.Errorf("lanczos lobe weight %v, want negative", w)
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		line   string
+		radius float64
+	}{
+		{"box", 0.5},
+		{"tent", 1},
+		{"tent 2", 2},
+		{"gaussian", 1.5},
+		{"mitchell", 2},
+		{"lanczos 0", 3},
+	}
+	for _, tt := range tests {
+		f, err := ParseFilter(strings.Fields(tt.line))
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %v", tt.line, err)
+			continue
+		}
+		if f.Radius() != tt.radius {
+			t.Errorf("ParseFilter(%q) radius %v, want %v", tt.line, f.Radius(), tt.radius)
+		}
+	}
+	if g, _ := ParseFilter([]string{"gaussian", "2", "3"}); g.(*GaussianFilter).Alpha != 3 {
+		t.Errorf("gaussian alpha %v, want 3", g.(*GaussianFilter).Alpha)
+	}
+	if _, err := ParseFilter([]string{"sinc"}); err == nil {
+		t.Error("unknown filter parsed")
+	}
+}
+
+func TestFramebuffer(t *testing.T) {
+	fb := NewFramebuffer(image.Rect(10, 10, 14, 14))
+	red := Color{1, 0, 0}
+
+	// a box filter keeps a sample in its own pixel
+	fb.AddSample(11.5, 11.5, red, &BoxFilter{R: 0.5})
+	if got := fb.Pixel(11, 11); got != red {
+		t.Errorf("pixel 11,11 = %v, want %v", got, red)
+	}
+	if got := fb.Pixel(12, 11); got != (Color{}) {
+		t.Errorf("pixel 12,11 = %v, want black", got)
+	}
+
+	// a tent spreads a sample on a pixel corner over the four pixels around it, and the
+	// weights are normalized per pixel
+	fb.AddSample(13, 13, Color{0, 0, 1}, &TentFilter{R: 1})
+	for _, p := range []image.Point{{12, 12}, {13, 12}, {12, 13}, {13, 13}} {
+		if got := fb.Pixel(p.X, p.Y); got != (Color{0, 0, 1}) {
+			t.Errorf("pixel %v = %v, want blue", p, got)
+		}
+	}
+
+	// samples outside the framebuffer only reach the pixels inside it
+	fb.AddSample(9.9, 10.5, Color{0, 1, 0}, &TentFilter{R: 1})
+	if got := fb.Pixel(10, 10); got != (Color{0, 1, 0}) {
+		t.Errorf("pixel 10,10 = %v, want green", got)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	fb.Resolve(img, image.Rect(0, 0, 12, 12))
+	if got := img.RGBAAt(11, 11); got != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("resolved pixel 11,11 = %v, want red", got)
+	}
+	if got := img.RGBAAt(12, 12); got != (color.RGBA{}) {
+		t.Errorf("pixel 12,12 outside the resolved rectangle = %v", got)
+	}
+	if got := img.RGBAAt(5, 5); got != (color.RGBA{}) {
+		t.Errorf("pixel 5,5 outside the framebuffer = %v", got)
+	}
+}
@@ -49,6 +49,21 @@ func (g *Group) CalcBounds() {
 	g.Bounds = NewSphere(g.Center.X, g.Center.Y, g.Center.Z, max, 0, g.Scene)
 }
 
+// BoundingSphere returns a sphere around the group's primitives, leaving out infinite planes,
+// and false if there are no other primitives.
+func (g *Group) BoundingSphere() (*Vector, float64, bool) {
+	radius := 0.0
+	found := false
+	for _, obj := range g.ObjectList {
+		if p, ok := obj.(*Plane); ok && p.infinite() {
+			continue
+		}
+		radius = math.Max(radius, obj.GetFurthest(g.Center))
+		found = true
+	}
+	return g.Center, radius, found
+}
+
 // HitBounds checks for intersection
 func (g *Group) HitBounds(r *Ray) bool {
 	if g.Always {
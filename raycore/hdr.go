@@ -0,0 +1,183 @@
+package raycore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"strings"
+)
+
+// HDRImage is a floating point image as read from a Radiance .hdr (RGBE) file.
+type HDRImage struct {
+	Width  int
+	Height int
+	Pix    []Color
+}
+
+// maxHDRPixels bounds the size of an .hdr file, so that a bad header cannot make the decoder
+// allocate without limit.
+const maxHDRPixels = 1 << 26
+
+func init() {
+	image.RegisterFormat("hdr", "#?", DecodeHDR, DecodeHDRConfig)
+}
+
+// ColorModel is part of image.Image, HDR values are clamped to [0,1] when converted.
+func (h *HDRImage) ColorModel() color.Model {
+	return color.RGBA64Model
+}
+
+// Bounds is part of image.Image.
+func (h *HDRImage) Bounds() image.Rectangle {
+	return image.Rect(0, 0, h.Width, h.Height)
+}
+
+// At is part of image.Image, use ColorAt to get the unclamped value.
+func (h *HDRImage) At(x, y int) color.Color {
+	c := h.ColorAt(x, y)
+	clamp := func(f float64) uint16 {
+		return uint16(math.Max(0.0, math.Min(f, 1.0)) * 0xffff)
+	}
+	return color.RGBA64{clamp(c.R), clamp(c.G), clamp(c.B), 0xffff}
+}
+
+// ColorAt returns the high dynamic range color of a pixel.
+func (h *HDRImage) ColorAt(x, y int) Color {
+	if x < 0 || y < 0 || x >= h.Width || y >= h.Height {
+		return Color{}
+	}
+	return h.Pix[y*h.Width+x]
+}
+
+// DecodeHDRConfig reads the header of a Radiance .hdr file.
+func DecodeHDRConfig(r io.Reader) (image.Config, error) {
+	w, h, err := readHDRHeader(bufio.NewReader(r))
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: color.RGBA64Model, Width: w, Height: h}, nil
+}
+
+// DecodeHDR reads a Radiance .hdr file, both flat and run length encoded scanlines are supported.
+func DecodeHDR(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	w, h, err := readHDRHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	img := &HDRImage{
+		Width:  w,
+		Height: h,
+		Pix:    make([]Color, w*h),
+	}
+	scan := make([]byte, w*4)
+	for y := 0; y < h; y++ {
+		if err := readHDRScanline(br, scan, w); err != nil {
+			return nil, err
+		}
+		for x := 0; x < w; x++ {
+			img.Pix[y*w+x] = rgbeToColor(scan[x*4 : x*4+4])
+		}
+	}
+	return img, nil
+}
+
+func readHDRHeader(br *bufio.Reader) (int, int, error) {
+	magic, err := br.ReadString('\n')
+	if err != nil {
+		return 0, 0, err
+	}
+	if !strings.HasPrefix(magic, "#?") {
+		return 0, 0, errors.New("hdr: not a radiance file")
+	}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return 0, 0, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "FORMAT=") && line != "FORMAT=32-bit_rle_rgbe" {
+			return 0, 0, fmt.Errorf("hdr: unsupported %s", line)
+		}
+	}
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return 0, 0, err
+	}
+	var w, h int
+	if _, err := fmt.Sscanf(line, "-Y %d +X %d", &h, &w); err != nil {
+		return 0, 0, fmt.Errorf("hdr: unsupported resolution %q", strings.TrimSpace(line))
+	}
+	if w <= 0 || h <= 0 || w > maxHDRPixels/h {
+		return 0, 0, fmt.Errorf("hdr: bad size %dx%d", w, h)
+	}
+	return w, h, nil
+}
+
+func readHDRScanline(br *bufio.Reader, scan []byte, w int) error {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return err
+	}
+	if w < 8 || w > 0x7fff || head[0] != 2 || head[1] != 2 || head[2]&0x80 != 0 {
+		// flat scanline
+		copy(scan, head)
+		_, err := io.ReadFull(br, scan[4:])
+		return err
+	}
+	if int(head[2])<<8|int(head[3]) != w {
+		return errors.New("hdr: scanline width mismatch")
+	}
+	// run length encoded, each of the four components separately
+	for ch := 0; ch < 4; ch++ {
+		for x := 0; x < w; {
+			count, err := br.ReadByte()
+			if err != nil {
+				return err
+			}
+			if count > 128 {
+				n := int(count - 128)
+				val, err := br.ReadByte()
+				if err != nil {
+					return err
+				}
+				if x+n > w {
+					return errors.New("hdr: bad run length")
+				}
+				for ; n > 0; n-- {
+					scan[x*4+ch] = val
+					x++
+				}
+			} else {
+				n := int(count)
+				if n == 0 || x+n > w {
+					return errors.New("hdr: bad run length")
+				}
+				for ; n > 0; n-- {
+					val, err := br.ReadByte()
+					if err != nil {
+						return err
+					}
+					scan[x*4+ch] = val
+					x++
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func rgbeToColor(rgbe []byte) Color {
+	if rgbe[3] == 0 {
+		return Color{}
+	}
+	f := math.Ldexp(1.0, int(rgbe[3])-(128+8))
+	return Color{float64(rgbe[0]) * f, float64(rgbe[1]) * f, float64(rgbe[2]) * f}
+}
@@ -0,0 +1,73 @@
+package raycore
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func hdrFile(w, h int, body ...byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "#?RADIANCE\nFORMAT=32-bit_rle_rgbe\n\n-Y %d +X %d\n", h, w)
+	b.Write(body)
+	return b.Bytes()
+}
+
+func TestDecodeHDR(t *testing.T) {
+	// an RLE scanline of 8 pixels: red a run of 1.0, green literal values, blue a run of 0,
+	// exponent a run of 129
+	rle := []byte{2, 2, 0, 8,
+		128 + 8, 128,
+		8, 0, 16, 32, 64, 128, 255, 1, 2,
+		128 + 8, 0,
+		128 + 8, 129,
+	}
+	tests := []struct {
+		name string
+		file []byte
+		want []Color
+	}{
+		{"flat", hdrFile(2, 1, 128, 64, 0, 129, 0, 0, 0, 0),
+			[]Color{{1.0, 0.5, 0.0}, {}}},
+		{"exponent", hdrFile(1, 1, 128, 128, 128, 131),
+			[]Color{{4.0, 4.0, 4.0}}},
+		{"rle", hdrFile(8, 1, rle...),
+			[]Color{{1, 0, 0}, {1, 0.125, 0}, {1, 0.25, 0}, {1, 0.5, 0},
+				{1, 1, 0}, {1, 255.0 / 128.0, 0}, {1, 1.0 / 128.0, 0}, {1, 2.0 / 128.0, 0}}},
+	}
+	for _, tt := range tests {
+		img, err := DecodeHDR(bytes.NewReader(tt.file))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		hdr := img.(*HDRImage)
+		for i, want := range tt.want {
+			if got := hdr.ColorAt(i, 0); got != want {
+				t.Errorf("%s: pixel %d = %v, want %v", tt.name, i, got, want)
+			}
+		}
+	}
+}
+
+func TestDecodeHDRErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file []byte
+	}{
+		{"magic", []byte("P6\n1 1\n255\n")},
+		{"format", []byte("#?RADIANCE\nFORMAT=32-bit_rle_xyze\n\n-Y 1 +X 1\n")},
+		{"resolution", []byte("#?RADIANCE\n\n+X 1 -Y 1\n")},
+		{"negative size", []byte("#?RADIANCE\n\n-Y -1 +X -1\n")},
+		{"zero size", hdrFile(0, 1)},
+		{"huge size", hdrFile(1<<20, 1<<20)},
+		{"short", hdrFile(2, 1, 128, 64, 0, 129)},
+		{"width", hdrFile(8, 1, 2, 2, 0, 9)},
+		{"run", hdrFile(8, 1, 2, 2, 0, 8, 128+9, 0)},
+	}
+	for _, tt := range tests {
+		if _, err := DecodeHDR(bytes.NewReader(tt.file)); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
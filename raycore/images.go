@@ -0,0 +1,123 @@
+package raycore
+
+import (
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// Decoder decodes an image from r.
+type Decoder func(r io.Reader) (image.Image, error)
+
+var (
+	decoderLock sync.RWMutex
+	decoders    = map[string]Decoder{
+		".png":  png.Decode,
+		".jpg":  jpeg.Decode,
+		".jpeg": jpeg.Decode,
+		".gif":  gif.Decode,
+		".bmp":  bmp.Decode,
+		".tif":  tiff.Decode,
+		".tiff": tiff.Decode,
+		".hdr":  DecodeHDR,
+	}
+)
+
+// RegisterDecoder sets the decoder used for image files with the extension ext, such as ".exr".
+func RegisterDecoder(ext string, decode Decoder) {
+	decoderLock.Lock()
+	defer decoderLock.Unlock()
+	decoders[strings.ToLower(ext)] = decode
+}
+
+// DecodeImageFile decodes an image file with the decoder registered for its extension. Files
+// with an unknown extension are decoded by any format registered with the image package.
+func DecodeImageFile(filename string) (image.Image, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	decoderLock.RLock()
+	decode, ok := decoders[strings.ToLower(filepath.Ext(filename))]
+	decoderLock.RUnlock()
+
+	var img image.Image
+	if ok {
+		img, err = decode(f)
+	} else {
+		img, _, err = image.Decode(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %v", filename, err)
+	}
+	return img, nil
+}
+
+// LoadImage returns the named image from the scene's image list, or else decodes it from file
+// and adds it to the list under its cleaned path, so that it is only decoded once however the
+// path is written.
+func (scn *Scene) LoadImage(filename string) (image.Image, error) {
+	scn.cacheLock.Lock()
+	defer scn.cacheLock.Unlock()
+	return scn.loadImage(filename)
+}
+
+func (scn *Scene) loadImage(filename string) (image.Image, error) {
+	key := scn.imageKey(filename)
+	if img, ok := scn.ImageList[key]; ok {
+		return img, nil
+	}
+	img, err := DecodeImageFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if scn.ImageList == nil {
+		// a scene not made by NewScene, such as one decoded from JSON
+		scn.ImageList = make(map[string]image.Image)
+	}
+	scn.ImageList[key] = img
+	return img, nil
+}
+
+// imageKey returns the name an image is kept under: the name itself if it is in the image
+// list, or else the cleaned path, so that refs/a.png and ./refs/a.png are the same image.
+func (scn *Scene) imageKey(filename string) string {
+	if _, ok := scn.ImageList[filename]; ok {
+		return filename
+	}
+	return filepath.Clean(filename)
+}
+
+// LoadTexture returns a new texture of the named image with the default options. Textures of
+// the same image share their mipmaps, which are only generated once per scene.
+func (scn *Scene) LoadTexture(filename string) (*ImageTexture, error) {
+	scn.cacheLock.Lock()
+	defer scn.cacheLock.Unlock()
+	if scn.textureCache == nil {
+		scn.textureCache = make(map[string]*ImageTexture)
+	}
+	key := scn.imageKey(filename)
+	cached, ok := scn.textureCache[key]
+	if !ok {
+		img, err := scn.loadImage(filename)
+		if err != nil {
+			return nil, err
+		}
+		cached = NewImageTexture(filename, img)
+		scn.textureCache[key] = cached
+	}
+	tex := *cached
+	return &tex, nil
+}
@@ -1,8 +1,155 @@
 package raycore
 
-// Light defines a raytracing light at a specific position. Kind can be either point or ambient.
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+)
+
+// Light defines a raytracing light. Kind can be ambient, point, directional or spot.
+// A directional light only uses Direction, which is the direction its parallel rays travel.
+// A spot light shines from Position along Direction in a cone of Angle degrees, the edge of
+// which fades out over the last Softness degrees.
+// Point and spot lights are attenuated over a distance d by 1/(Constant + Linear*d + Quadratic*d*d).
+// A geometry light is an emissive primitive in the scene, Shape, of which a random point is
+// sampled every time it is used so that oversampling averages out to a soft shadow. If its
+// material has an emission map the light varies over the shape as the map does.
 type Light struct {
-	Position *Vector
-	Color    Color
-	Kind     string
+	Position  *Vector
+	Color     Color
+	Kind      string
+	Direction *Vector
+	Angle     float64
+	Softness  float64
+	Constant  float64
+	Linear    float64
+	Quadratic float64
+	Shape     Emitter `json:"-"`
+	group     int
+	object    int
+	material  *Material // with an emission map, else nil
+	center    *Vector   // of the group, for object space maps
+}
+
+// NewLight creates a light of the given kind without any attenuation.
+func NewLight(position *Vector, color Color, kind string) *Light {
+	return &Light{
+		Position: position,
+		Color:    color,
+		Kind:     kind,
+		Constant: 1.0,
+	}
+}
+
+// NewGeometryLight creates a light from the emissive object i in group g.
+func NewGeometryLight(shape Emitter, emission Color, g, i int) *Light {
+	return &Light{
+		Color:  emission,
+		Kind:   "geometry",
+		Shape:  shape,
+		group:  g,
+		object: i,
+	}
+}
+
+// IsShape reports whether the light is the geometry of object i in group g.
+func (l *Light) IsShape(g, i int) bool {
+	return l.Kind == "geometry" && l.group == g && l.object == i
+}
+
+// emittedAt returns the light given off at the point p on the shape of a geometry light.
+func (l *Light) emittedAt(p *Vector) Color {
+	obj, ok := l.Shape.(Object)
+	if l.material == nil || !ok {
+		return l.Color
+	}
+	u, v := obj.GetUV(p)
+	return l.material.At(&Hit{Point: p, Local: p.Sub(l.center), U: u, V: v}).Emitted()
+}
+
+// SetAttenuation sets the attenuation from one of the named falloffs constant, linear or
+// inverse-square.
+func (l *Light) SetAttenuation(falloff string) bool {
+	switch falloff {
+	case "none", "constant":
+		l.Constant, l.Linear, l.Quadratic = 1.0, 0.0, 0.0
+	case "linear":
+		l.Constant, l.Linear, l.Quadratic = 0.0, 1.0, 0.0
+	case "inverse-square", "quadratic":
+		l.Constant, l.Linear, l.Quadratic = 0.0, 0.0, 1.0
+	default:
+		return false
+	}
+	return true
+}
+
+// Illuminate returns the normalized direction from point towards the light, the distance to
+// the light and the color of the light arriving at point. The color is black if the point is
+// not lit, for instance when it falls outside a spot light's cone.
+func (l *Light) Illuminate(point *Vector) (*Vector, float64, Color) {
+	if l.Kind == "directional" {
+		return l.Direction.Mul(-1.0), MAX_DIST, l.Color
+	}
+	if l.Kind == "geometry" {
+		dir, dist, pdf := l.Shape.SampleLight(point, rand.Float64(), rand.Float64())
+		if pdf <= 0.0 {
+			return &Vector{0, 0, 1}, 0.0, Color{}
+		}
+		// stop the shadow ray just short of the emitting surface itself
+		return dir, dist * (1.0 - 1e-6), l.emittedAt(point.Add(dir.Mul(dist))).Mul(1.0 / (math.Pi * pdf))
+	}
+
+	toLight := l.Position.Sub(point)
+	dist := toLight.Module()
+	dir := toLight.Normalize()
+	col := l.Color
+
+	if l.Kind == "spot" {
+		cosAngle := -dir.Dot(l.Direction)
+		outer := math.Cos(0.5 * l.Angle * PI_180)
+		if cosAngle < outer {
+			return dir, dist, Color{}
+		}
+		inner := math.Cos(math.Max(0.0, 0.5*l.Angle-l.Softness) * PI_180)
+		if cosAngle < inner {
+			t := (cosAngle - outer) / (inner - outer)
+			col = col.Mul(t * t * (3.0 - 2.0*t)) // smoothstep
+		}
+	}
+
+	if att := l.Constant + l.Linear*dist + l.Quadratic*dist*dist; att > 0.0 {
+		col = col.Mul(1.0 / att)
+	}
+	return dir, dist, col
+}
+
+// ParseLight creates a light from a scene file light line:
+//
+//	x y z r g b ambient|point [falloff|c l q]
+//	dx dy dz r g b directional
+//	x y z r g b spot dx dy dz angle softness [falloff|c l q]
+func ParseLight(line []string) (*Light, error) {
+	l := NewLight(ParseVector(line[0:3]), ParseColor(line[3:6]), line[6])
+	rest := line[7:]
+	switch l.Kind {
+	case "directional":
+		l.Direction = l.Position.Normalize()
+	case "spot":
+		l.Direction = ParseVector(rest[0:3]).Normalize()
+		l.Angle, _ = strconv.ParseFloat(rest[3], 64)
+		l.Softness, _ = strconv.ParseFloat(rest[4], 64)
+		rest = rest[5:]
+	}
+	switch {
+	case len(rest) >= 3:
+		l.Constant, _ = strconv.ParseFloat(rest[0], 64)
+		l.Linear, _ = strconv.ParseFloat(rest[1], 64)
+		l.Quadratic, _ = strconv.ParseFloat(rest[2], 64)
+	case len(rest) == 1:
+		if !l.SetAttenuation(rest[0]) {
+			return nil, fmt.Errorf("unknown falloff %s", rest[0])
+		}
+	}
+	return l, nil
 }
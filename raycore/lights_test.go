@@ -0,0 +1,144 @@
+package raycore
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestParseLight(t *testing.T) {
+	tests := []struct {
+		line    string
+		kind    string
+		c, l, q float64
+		wantErr bool
+	}{
+		{"0 0 10 1 1 1 point", "point", 1, 0, 0, false},
+		{"0 0 10 1 1 1 point linear", "point", 0, 1, 0, false},
+		{"0 0 10 1 1 1 point inverse-square", "point", 0, 0, 1, false},
+		{"0 0 10 1 1 1 point 1 0.5 0.25", "point", 1, 0.5, 0.25, false},
+		{"0 0 -1 1 1 1 directional", "directional", 1, 0, 0, false},
+		{"0 0 10 1 1 1 spot 0 0 -1 30 5 quadratic", "spot", 0, 0, 1, false},
+		{"0 0 10 1 1 1 point inverse-sqaure", "", 0, 0, 0, true},
+		{"0 0 10 1 1 1 spot 0 0 -1 30 5 lin", "", 0, 0, 0, true},
+	}
+	for _, tt := range tests {
+		l, err := ParseLight(strings.Fields(tt.line))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseLight(%q) returned no error", tt.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseLight(%q): %v", tt.line, err)
+			continue
+		}
+		if l.Kind != tt.kind || l.Constant != tt.c || l.Linear != tt.l || l.Quadratic != tt.q {
+			t.Errorf("ParseLight(%q) = %s %v %v %v, want %s %v %v %v", tt.line,
+				l.Kind, l.Constant, l.Linear, l.Quadratic, tt.kind, tt.c, tt.l, tt.q)
+		}
+	}
+}
+
+func TestGeometryLightEmissionMap(t *testing.T) {
+	scn, err := ParseScene(testCamera + `
+material 1.0 1.0 1.0 1.0 0.0 0.0 0.0 0.0 0.0
+emission 1.0 1.0 1.0 2.0
+pattern emission checker object 0.5 1 0 0 0 0 1
+group lamp 5.0 0.0 0.0 false
+sphere 0 5.0 0.0 0.0 1.0
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var light *Light
+	for _, l := range scn.LightList {
+		if l.Kind == "geometry" {
+			light = l
+		}
+	}
+	if light == nil {
+		t.Fatal("no geometry light for the emissive sphere")
+	}
+	// object space is relative to the group center at x 5
+	if got, want := light.emittedAt(&Vector{5.9, 0.1, 0.1}), (Color{2, 0, 0}); got != want {
+		t.Errorf("emitted %v on the +x side, want %v", got, want)
+	}
+	if got, want := light.emittedAt(&Vector{4.1, 0.1, 0.1}), (Color{0, 0, 2}); got != want {
+		t.Errorf("emitted %v on the -x side, want %v", got, want)
+	}
+}
+
+func TestSampleLight(t *testing.T) {
+	scn := &Scene{MaterialList: []*Material{{}}}
+	// a unit cube and a cylinder of radius 0.5 around the origin, seen from 4.5 above their top
+	point := &Vector{0, 0, 5}
+	d := 4.5
+	tests := []struct {
+		name       string
+		shape      Emitter
+		solidAngle float64
+		// surface reports whether p is on the surface of the shape
+		surface func(p *Vector) bool
+	}{
+		{"cube", NewCube(0, 0, -0.5, 1, 1, 1, 0, scn), 4 * math.Asin(0.25/(0.25+d*d)),
+			func(p *Vector) bool {
+				m := math.Max(math.Max(math.Abs(p.X), math.Abs(p.Y)), math.Abs(p.Z))
+				return math.Abs(m-0.5) < 1e-9
+			}},
+		{"cylinder", NewCylinder(0, 0, -0.5, 0, 0, 1, 1, 0.5, 0, scn), 2 * math.Pi * (1 - d/math.Sqrt(d*d+0.25)),
+			func(p *Vector) bool {
+				r := math.Hypot(p.X, p.Y)
+				return r < 0.5+1e-9 && math.Abs(p.Z) < 0.5+1e-9 &&
+					(math.Abs(r-0.5) < 1e-9 || math.Abs(math.Abs(p.Z)-0.5) < 1e-9)
+			}},
+	}
+	const n = 600
+	for _, tt := range tests {
+		// the samples that are picked are on the surface, and 1/pdf over all of them adds up
+		// to the solid angle the shape fills, so only the side facing point is picked
+		sum := 0.0
+		for i := 0; i < n; i++ {
+			for j := 0; j < n; j++ {
+				dir, dist, pdf := tt.shape.SampleLight(point, (float64(i)+0.5)/n, (float64(j)+0.5)/n)
+				if pdf <= 0.0 {
+					continue
+				}
+				sum += 1.0 / pdf
+				if p := point.Add(dir.Mul(dist)); !tt.surface(p) {
+					t.Fatalf("%s: sample %v is not on the surface", tt.name, p)
+				}
+			}
+		}
+		if got := sum / (n * n); math.Abs(got-tt.solidAngle) > 0.01*tt.solidAngle {
+			t.Errorf("%s: solid angle %v, want %v", tt.name, got, tt.solidAngle)
+		}
+	}
+}
+
+func TestEmissivePrimitives(t *testing.T) {
+	scn, err := ParseScene(testCamera + `
+material 1.0 1.0 1.0 1.0 0.0 0.0 0.0 0.0 0.0
+emission 1.0 1.0 1.0 2.0
+group leds 0.0 0.0 0.0 false
+cube 0 0.0 0.0 0.0 0.2 0.2 0.2
+cylinder 0 1.0 0.0 0.0 0.0 0.0 1.0 0.5 0.1
+plane 0 0.0 0.0 -1.0 0.0 0.0 1.0 0.0 1.0 0.0 0.0 0.0 0.0
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lights := 0
+	for _, l := range scn.LightList {
+		if l.Kind == "geometry" {
+			lights++
+		}
+	}
+	if lights != 2 {
+		t.Errorf("%d geometry lights, want the cube and the cylinder", lights)
+	}
+	if len(scn.Warnings) != 1 || !strings.Contains(scn.Warnings[0], "plane 2 in group leds") {
+		t.Errorf("warnings %q, want one for the infinite plane", scn.Warnings)
+	}
+}
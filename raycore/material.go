@@ -3,9 +3,27 @@ package raycore
 import ()
 
 // Material defines a raytracing material.
+// The default Phong model uses the Difuse, Specular, Reflection and Transmit coefficients.
+// The "pbr" Model is a metal/roughness microfacet model where Color is the base color and
+// only Metallic, Roughness, Transmission and IOR are used.
+// Both models glow with the Emission color times EmissionStrength.
+// The texture maps vary a channel over the surface of the primitive: DiffuseMap and
+// EmissionMap multiply the Color and Emission, the other maps multiply their scalar by the
+// brightness of the map.
+// NormalMap and BumpMap tilt the normal used for shading. A normal map holds tangent-space
+// normals, with red along u and green up the image, and a bump map holds heights that are
+// scaled by BumpStrength into scene units.
 type Material struct {
 	Color                                                              Color
 	DifuseCol, SpecularCol, SpecularD, ReflectionCol, TransmitCol, IOR float64
+	Model                                                              string
+	Metallic, Roughness, Transmission                                  float64
+	Emission                                                           Color
+	EmissionStrength                                                   float64
+	DiffuseMap, EmissionMap                                            TextureMap
+	RoughnessMap, MetallicMap, ReflectionMap                           TextureMap
+	NormalMap, BumpMap                                                 TextureMap
+	BumpStrength                                                       float64
 }
 
 func NewMaterial(color Color, difusecol, specularcol, speculard, reflectioncol, transmitcol, ior float64) (*Material, error) {
@@ -21,3 +39,69 @@ func NewMaterial(color Color, difusecol, specularcol, speculard, reflectioncol,
 	return m, nil
 
 }
+
+// NewPBRMaterial creates a metal/roughness material. Metallic, roughness and transmission
+// are in [0,1], ior is only used if the material transmits light.
+func NewPBRMaterial(color Color, metallic, roughness, transmission, ior float64) (*Material, error) {
+	m := &Material{
+		Color:        color,
+		Model:        "pbr",
+		Metallic:     metallic,
+		Roughness:    roughness,
+		Transmission: transmission,
+		IOR:          ior,
+	}
+	if m.IOR == 0.0 {
+		m.IOR = 1.5
+	}
+	return m, nil
+}
+
+// Emitted returns the light given off by the material.
+func (m *Material) Emitted() Color {
+	return m.Emission.Mul(m.EmissionStrength)
+}
+
+// SetMap sets the texture map of a channel, which is one of color, emission, roughness,
+// metallic or reflection.
+func (m *Material) SetMap(channel string, t TextureMap) bool {
+	switch channel {
+	case "color", "diffuse":
+		m.DiffuseMap = t
+	case "emission":
+		m.EmissionMap = t
+	case "roughness":
+		m.RoughnessMap = t
+	case "metallic":
+		m.MetallicMap = t
+	case "reflection":
+		m.ReflectionMap = t
+	default:
+		return false
+	}
+	return true
+}
+
+// HasMaps reports whether any channel of the material has a texture map.
+func (m *Material) HasMaps() bool {
+	return m.DiffuseMap != nil || m.EmissionMap != nil || m.RoughnessMap != nil ||
+		m.MetallicMap != nil || m.ReflectionMap != nil || m.NormalMap != nil || m.BumpMap != nil
+}
+
+// At returns a copy of the material with the maps, other than the DiffuseMap, applied at h.
+func (m *Material) At(h *Hit) *Material {
+	at := *m
+	if m.EmissionMap != nil {
+		at.Emission = m.Emission.MulColor(m.EmissionMap.GetColor(h))
+	}
+	if m.RoughnessMap != nil {
+		at.Roughness *= m.RoughnessMap.GetColor(h).Luminance()
+	}
+	if m.MetallicMap != nil {
+		at.Metallic *= m.MetallicMap.GetColor(h).Luminance()
+	}
+	if m.ReflectionMap != nil {
+		at.ReflectionCol *= m.ReflectionMap.GetColor(h).Luminance()
+	}
+	return &at
+}
@@ -0,0 +1,122 @@
+package raycore
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"io/ioutil"
+)
+
+// RenderRegion records where a partial render belongs: the size of the full image and the
+// rectangle of it that was rendered.
+type RenderRegion struct {
+	Width  int
+	Height int
+	Rect   image.Rectangle
+}
+
+// RenderRegion returns the region of the full image the scene renders.
+func (scn *Scene) RenderRegion() RenderRegion {
+	return RenderRegion{Width: scn.ImgWidth, Height: scn.ImgHeight, Rect: scn.Region()}
+}
+
+// WriteRegionFile writes the region of a partial render to the sidecar file of its image,
+// the image file name with .json added.
+func WriteRegionFile(imagefile string, region RenderRegion) error {
+	buf, err := json.MarshalIndent(region, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(imagefile+".json", buf, 0644)
+}
+
+// Part is a partial render, with Image either the rendered rectangle alone or an image of
+// the full size, and Name to tell it by in errors.
+type Part struct {
+	Name   string
+	Image  image.Image
+	Region RenderRegion
+}
+
+// LoadPart reads a partial render from an image file and its sidecar file.
+func LoadPart(imagefile string) (*Part, error) {
+	img, err := DecodeImageFile(imagefile)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadFile(imagefile + ".json")
+	if err != nil {
+		return nil, err
+	}
+	part := &Part{Name: imagefile, Image: img}
+	if err := json.Unmarshal(buf, &part.Region); err != nil {
+		return nil, fmt.Errorf("%s.json: %v", imagefile, err)
+	}
+	return part, nil
+}
+
+// maxMergePixels bounds the size of a merged image, as read from a sidecar file.
+const maxMergePixels = 1 << 28
+
+// MergeImages combines partial renders of the same image into the full image. It returns an
+// error unless the parts cover every pixel of the image exactly once.
+func MergeImages(parts []*Part) (*image.RGBA, error) {
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("no images to merge")
+	}
+	width, height := parts[0].Region.Width, parts[0].Region.Height
+	if width <= 0 || height <= 0 || width > maxMergePixels/height {
+		return nil, fmt.Errorf("%s: bad image size %dx%d", parts[0].Name, width, height)
+	}
+	full := image.Rect(0, 0, width, height)
+	merged := image.NewRGBA(full)
+	owner := make([]*Part, width*height)
+
+	for _, part := range parts {
+		rect := part.Region.Rect
+		if part.Region.Width != width || part.Region.Height != height {
+			return nil, fmt.Errorf("%s: part of a %dx%d image, not %dx%d",
+				part.Name, part.Region.Width, part.Region.Height, width, height)
+		}
+		if rect.Empty() || !rect.In(full) {
+			return nil, fmt.Errorf("%s: region %v outside the image", part.Name, rect)
+		}
+		// where the region starts in the part's image
+		bounds := part.Image.Bounds()
+		var at image.Point
+		switch bounds.Size() {
+		case rect.Size():
+			at = bounds.Min
+		case full.Size():
+			at = bounds.Min.Add(rect.Min)
+		default:
+			return nil, fmt.Errorf("%s: image of %v fits neither the region %v nor the full image",
+				part.Name, bounds.Size(), rect)
+		}
+
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			for x := rect.Min.X; x < rect.Max.X; x++ {
+				if other := owner[y*width+x]; other != nil {
+					return nil, fmt.Errorf("pixel %d,%d is in both %s and %s", x, y, other.Name, part.Name)
+				}
+				owner[y*width+x] = part
+			}
+		}
+		draw.Draw(merged, rect, part.Image, at, draw.Src)
+	}
+
+	missing, gap := 0, image.Rectangle{}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if owner[y*width+x] == nil {
+				missing++
+				gap = gap.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	if missing > 0 {
+		return nil, fmt.Errorf("%d pixels within %v are in none of the images", missing, gap)
+	}
+	return merged, nil
+}
@@ -0,0 +1,100 @@
+package raycore
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const mergeTestScene = testScene + "filter gaussian\n"
+
+// renderPart renders the crop window of mergeTestScene given by crop, a crop line.
+func renderPart(t *testing.T, name, crop string) *Part {
+	scn, err := ParseScene(mergeTestScene + crop + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rg, _ := NewRayGunFromScene(scn, 2)
+	if err := rg.RenderContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return &Part{Name: name, Image: scn.Output(), Region: scn.RenderRegion()}
+}
+
+func TestMergeImages(t *testing.T) {
+	full := renderLocal(t, mergeTestScene)
+
+	// one part written as the crop window alone and one as a full size image, split across
+	// the ball so that the filter reaches over the seam
+	top := renderPart(t, "top", "crop 0 0 32 11 only")
+	bottom := renderPart(t, "bottom", "crop 0 11 32 24")
+	if top.Image.Bounds().Size() != image.Pt(32, 11) || bottom.Image.Bounds().Size() != image.Pt(32, 24) {
+		t.Fatalf("parts of %v and %v", top.Image.Bounds(), bottom.Image.Bounds())
+	}
+	merged, err := MergeImages([]*Part{top, bottom})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(merged.Pix, full.Pix) {
+		t.Error("merged image differs from the full render")
+	}
+
+	left := renderPart(t, "left", "crop 0 0 17 24 only")
+	right := renderPart(t, "right", "crop 16 0 32 24 only")
+	gap := renderPart(t, "gap", "crop 18 0 32 24 only")
+	bad := func(width, height int) *Part {
+		return &Part{Name: "bad", Image: left.Image, Region: RenderRegion{width, height, left.Region.Rect}}
+	}
+	tests := []struct {
+		name  string
+		parts []*Part
+		err   string
+	}{
+		{"none", nil, "no images"},
+		{"overlap", []*Part{left, right}, "pixel 16,0 is in both left and right"},
+		{"gap", []*Part{left, gap}, "24 pixels within (17,0)-(18,24) are in none"},
+		{"size", []*Part{left, bad(64, 24)}, "part of a 64x24 image"},
+		{"zero size", []*Part{bad(0, 24), left}, "bad image size"},
+		{"huge size", []*Part{bad(1<<20, 1<<20), left}, "bad image size"},
+		{"image size", []*Part{{Name: "odd", Image: image.NewRGBA(image.Rect(0, 0, 5, 5)), Region: left.Region}}, "fits neither"},
+	}
+	for _, tt := range tests {
+		_, err := MergeImages(tt.parts)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want one containing %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestLoadPart(t *testing.T) {
+	part := renderPart(t, "left", "crop 0 0 17 24 only")
+	filename := filepath.Join(t.TempDir(), "left.png")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	png.Encode(f, part.Image)
+	f.Close()
+	if err := WriteRegionFile(filename, part.Region); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadPart(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Region != part.Region || loaded.Image.Bounds().Size() != part.Image.Bounds().Size() {
+		t.Errorf("loaded region %v of image %v, want %v of %v",
+			loaded.Region, loaded.Image.Bounds(), part.Region, part.Image.Bounds())
+	}
+
+	os.Remove(filename + ".json")
+	if _, err := LoadPart(filename); err == nil {
+		t.Error("part without a sidecar file loaded")
+	}
+}
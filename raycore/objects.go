@@ -1,11 +1,9 @@
 package raycore
 
 import (
+	"errors"
 	"image"
-	"image/png"
 	"math"
-	"os"
-	"strings"
 )
 
 // EPS is used for the nuances of comparing float values.
@@ -19,15 +17,26 @@ type GroupBounds interface {
 }
 
 // Object is the interface all primitives must have to exist in a raytracing scene.
+// GetTangent returns the directions along the surface in which u and v of GetUV increase.
 type Object interface {
 	GetType() string
 	GetMaterial() *Material
 	SetMaterial(int)
 	GetIntersect(r *Ray, g, i int) bool
 	GetNormal(point *Vector) *Vector
+	GetUV(point *Vector) (float64, float64)
+	GetTangent(point *Vector) (*Vector, *Vector)
 	GetFurthest(point *Vector) float64
 }
 
+// Emitter is implemented by primitives that can light the scene when their material is emissive.
+// SampleLight picks a point on the primitive, as seen from point, using the uniform random numbers
+// u1 and u2. It returns the direction and distance to that point and the probability density of
+// having picked that direction per unit solid angle, which is zero if nothing was picked.
+type Emitter interface {
+	SampleLight(point *Vector, u1, u2 float64) (*Vector, float64, float64)
+}
+
 // Base has the default fields and method that is common to all primitives.
 type Base struct {
 	Scene         *Scene `json:"-"`
@@ -136,6 +145,45 @@ func (e *Sphere) GetNormal(point *Vector) *Vector {
 	return normal.Normalize()
 }
 
+// GetUV maps the sphere with u around the Z axis and v from the top (+Z) to the bottom.
+func (e *Sphere) GetUV(point *Vector) (float64, float64) {
+	d := point.Sub(e.Position).Normalize()
+	u := 0.5 + math.Atan2(d.Y, d.X)/(2.0*math.Pi)
+	v := 0.5 - math.Asin(math.Max(-1.0, math.Min(1.0, d.Z)))/math.Pi
+	return u, v
+}
+
+func (e *Sphere) GetTangent(point *Vector) (*Vector, *Vector) {
+	d := point.Sub(e.Position).Normalize()
+	ring := d.X*d.X + d.Y*d.Y
+	if ring < EPS {
+		return orthonormalBasis(d)
+	}
+	t := &Vector{-d.Y, d.X, 0.0}
+	b := &Vector{d.Z * d.X, d.Z * d.Y, -ring}
+	return t.Normalize(), b.Normalize()
+}
+
+// SampleLight picks a direction in the cone that the sphere fills as seen from point.
+func (e *Sphere) SampleLight(point *Vector, u1, u2 float64) (*Vector, float64, float64) {
+	toCenter := e.Position.Sub(point)
+	d2 := toCenter.Dot(toCenter)
+	if d2 <= e.Radius*e.Radius {
+		return toCenter, 0.0, 0.0
+	}
+	d := math.Sqrt(d2)
+	cosMax := math.Sqrt(1.0 - e.Radius*e.Radius/d2)
+	cosTheta := 1.0 - u1*(1.0-cosMax)
+	sinTheta := math.Sqrt(math.Max(0.0, 1.0-cosTheta*cosTheta))
+	phi := 2.0 * math.Pi * u2
+
+	w := toCenter.Mul(1.0 / d)
+	t, b := orthonormalBasis(w)
+	dir := t.Mul(sinTheta * math.Cos(phi)).Add(b.Mul(sinTheta * math.Sin(phi))).Add(w.Mul(cosTheta))
+	dist := d*cosTheta - math.Sqrt(math.Max(0.0, e.Radius*e.Radius-d2*sinTheta*sinTheta))
+	return dir, dist, 1.0 / (2.0 * math.Pi * (1.0 - cosMax))
+}
+
 // Furthest calculates the firhest distance this sphere can be from a the point.
 // This is used to calculate the group bounds if this sphere is a child of a group.
 func (e *Sphere) GetFurthest(point *Vector) float64 {
@@ -261,6 +309,71 @@ func (p *Plane) GetNormal(point *Vector) *Vector {
 	return p.Normal
 }
 
+// GetUV maps a disc or rectangle onto [0,1] the same way a Texture is mapped. An infinite
+// plane is mapped in scene units so that textures repeat every unit.
+func (p *Plane) GetUV(point *Vector) (float64, float64) {
+	u := point.Sub(p.Position)
+	horiz := u.Dot(p.Horiz)
+	vert := u.Dot(p.Vert)
+	switch {
+	case p.Radius > 0.0:
+		return 0.5 - horiz/(2.0*p.Radius), 0.5 + vert/(2.0*p.Radius)
+	case p.Width > 0.0 && p.Height > 0.0:
+		return 0.5 - horiz/p.Width, 0.5 + vert/p.Height
+	}
+	return -horiz, vert
+}
+
+func (p *Plane) GetTangent(point *Vector) (*Vector, *Vector) {
+	return p.Horiz.Mul(-1.0), p.Vert
+}
+
+// SampleLight picks a point on a disc or rectangle, infinite planes cannot be sampled.
+func (p *Plane) SampleLight(point *Vector, u1, u2 float64) (*Vector, float64, float64) {
+	var sample *Vector
+	var area float64
+	switch {
+	case p.Radius > 0.0:
+		rad := p.Radius * math.Sqrt(u1)
+		phi := 2.0 * math.Pi * u2
+		sample = p.Position.Add(p.Horiz.Mul(rad * math.Cos(phi))).Add(p.Vert.Mul(rad * math.Sin(phi)))
+		area = math.Pi * p.Radius * p.Radius
+	case p.Width > 0.0 && p.Height > 0.0:
+		sample = p.Position.Add(p.Horiz.Mul((u1 - 0.5) * p.Width)).Add(p.Vert.Mul((u2 - 0.5) * p.Height))
+		area = p.Width * p.Height
+	default:
+		return p.Normal, 0.0, 0.0
+	}
+	toSample := sample.Sub(point)
+	dist := toSample.Module()
+	dir := toSample.Normalize()
+	cosLight := math.Abs(p.Normal.Dot(dir))
+	if dist == 0.0 || cosLight < EPS {
+		return dir, 0.0, 0.0
+	}
+	return dir, dist, dist * dist / (cosLight * area)
+}
+
+// sampleSurface returns the direction and distance from point to sample, a point picked
+// uniformly over the surface of a convex primitive of the given area, and the probability
+// density per unit solid angle of having picked it. A sample on the side facing away from
+// point is hidden by the primitive itself and is not picked.
+func sampleSurface(point, sample, normal *Vector, area float64) (*Vector, float64, float64) {
+	toSample := sample.Sub(point)
+	dist := toSample.Module()
+	dir := toSample.Normalize()
+	cosLight := -normal.Dot(dir)
+	if dist == 0.0 || cosLight < EPS {
+		return dir, 0.0, 0.0
+	}
+	return dir, dist, dist * dist / (cosLight * area)
+}
+
+// infinite reports whether the plane is neither a disc nor a rectangle.
+func (p *Plane) infinite() bool {
+	return p.Radius <= 0.0 && (p.Width <= 0.0 || p.Height <= 0.0)
+}
+
 func (p *Plane) GetFurthest(point *Vector) float64 {
 	dist := p.Position.Sub(point).Module()
 	if p.Radius > 0.0 {
@@ -284,10 +397,11 @@ type Texture struct {
 	halfWidth  float64 `json:"-"`
 	halfHeight float64 `json:"-"`
 	ImageName  string
-	Image      image.Image `json:"-"`
+	Image      image.Image   `json:"-"`
+	Map        *ImageTexture `json:"-"`
 }
 
-func NewTexture(xp, yp, zp, xn, yn, zn, ux, uy, uz, w, h float64, filename string, scn *Scene) *Texture {
+func NewTexture(xp, yp, zp, xn, yn, zn, ux, uy, uz, w, h float64, filename string, scn *Scene) (*Texture, error) {
 	mat, _ := NewMaterial(Color{1.0, 1.0, 1.0}, 1.0, 0.0, 0.0, 0.0, 0.0, 0.0)
 	t := &Texture{
 		Scene:      scn,
@@ -303,27 +417,23 @@ func NewTexture(xp, yp, zp, xn, yn, zn, ux, uy, uz, w, h float64, filename strin
 		ImageName:  filename,
 		Image:      nil,
 	}
-	if filename != "" {
-		if strings.Contains(filename, ".png") {
-			f, err := os.Open(filename)
-			if err != nil {
-				return nil
-			}
-			defer f.Close()
-			t.Image, err = png.Decode(f)
-			if err != nil {
-				return nil
-			}
-		} else {
-			// if not a file then an index into the scenes image list
-			t.Image = scn.ImageList[filename]
-		}
+	if filename == "" {
+		return nil, errors.New("texture needs an image")
+	}
+	// the name is either in the scene's image list or an image file
+	var err error
+	if t.Image, err = scn.LoadImage(filename); err != nil {
+		return nil, err
+	}
+	if t.Map, err = scn.LoadTexture(filename); err != nil {
+		return nil, err
 	}
+	t.Map.Wrap = "clamp"
 
 	t.Horiz = t.Normal.Cross(t.Up).Normalize()
 	t.Vert = t.Normal.Cross(t.Horiz).Normalize()
 
-	return t
+	return t, nil
 }
 
 func (t *Texture) GetType() string {
@@ -388,7 +498,7 @@ func (t *Texture) GetIntersect(r *Ray, g, i int) bool {
 		return false
 	}
 	imgy := t.halfHeight + vert
-	color, hasColor := t.getColor((t.Width-imgx)/t.Width, imgy/t.Height)
+	color, hasColor := t.getColor((t.Width-imgx)/t.Width, imgy/t.Height, r.footprint(w)/math.Max(t.Width, t.Height))
 	if !hasColor {
 		return false
 	}
@@ -405,25 +515,29 @@ func (t *Texture) GetNormal(point *Vector) *Vector {
 	return t.Normal
 }
 
+func (t *Texture) GetUV(point *Vector) (float64, float64) {
+	u := point.Sub(t.Position)
+	return 0.5 - u.Dot(t.Horiz)/t.Width, 0.5 + u.Dot(t.Vert)/t.Height
+}
+
+func (t *Texture) GetTangent(point *Vector) (*Vector, *Vector) {
+	return t.Horiz.Mul(-1.0), t.Vert
+}
+
 func (t *Texture) GetFurthest(point *Vector) float64 {
 	dist := t.Position.Sub(point).Module()
 	return dist + math.Sqrt(t.halfWidth*t.halfWidth+t.halfHeight*t.halfHeight)
 }
 
-func (t *Texture) getColor(x, y float64) (Color, bool) {
-	bounds := t.Image.Bounds()
-	imgx := x*float64(bounds.Max.X-bounds.Min.X) + float64(bounds.Min.X)
-	imgy := y*float64(bounds.Max.Y-bounds.Min.Y) + float64(bounds.Min.Y)
-	col := t.Image.At(int(imgx), int(imgy))
-	r, g, b, a := col.RGBA()
-	fr := float64(r)
-	fg := float64(g)
-	fb := float64(b)
-	fa := float64(a)
-	if a == 0x0000 {
-		return Color{fr / fa, fg / fa, fb / fa}, false
+// getColor returns the color of the image at x,y and whether the texture is there. It is cut
+// out where the image is fully transparent or, when filtered, less than half opaque, so that
+// filtering does not spread a fringe around the cut out shape.
+func (t *Texture) getColor(x, y, footprint float64) (Color, bool) {
+	col, alpha := t.Map.Sample(x, y, footprint)
+	if t.Map.Filter == "nearest" {
+		return col, alpha > 0.0
 	}
-	return Color{fr / fa, fg / fa, fb / fa}, true // FromColor(mat.Image.At(int(imgx), int(imgy)))
+	return col, alpha >= 0.5
 }
 
 // Cube
@@ -488,6 +602,72 @@ func (c *Cube) GetNormal(point *Vector) *Vector {
 	return &Vector{0, 1, 0}
 }
 
+// GetUV maps the whole of [0,1] onto each face of the cube.
+func (c *Cube) GetUV(point *Vector) (float64, float64) {
+	size := c.Max.Sub(c.Min)
+	fx := (point.X - c.Min.X) / size.X
+	fy := (point.Y - c.Min.Y) / size.Y
+	fz := (point.Z - c.Min.Z) / size.Z
+	n := c.GetNormal(point)
+	switch {
+	case n.X != 0.0:
+		return 0.5 + n.X*(fy-0.5), 1.0 - fz
+	case n.Y != 0.0:
+		return 0.5 - n.Y*(fx-0.5), 1.0 - fz
+	}
+	return fx, 0.5 - n.Z*(fy-0.5)
+}
+
+func (c *Cube) GetTangent(point *Vector) (*Vector, *Vector) {
+	n := c.GetNormal(point)
+	switch {
+	case n.X != 0.0:
+		return &Vector{0, n.X, 0}, &Vector{0, 0, -1}
+	case n.Y != 0.0:
+		return &Vector{-n.Y, 0, 0}, &Vector{0, 0, -1}
+	}
+	return &Vector{1, 0, 0}, &Vector{0, -n.Z, 0}
+}
+
+// SampleLight picks a point on one of the faces of the cube, each face as likely as its area.
+func (c *Cube) SampleLight(point *Vector, u1, u2 float64) (*Vector, float64, float64) {
+	size := c.Max.Sub(c.Min)
+	faces := [3]float64{size.Y * size.Z, size.X * size.Z, size.X * size.Y} // across x, y and z
+	area := 2.0 * (faces[0] + faces[1] + faces[2])
+	if area <= 0.0 {
+		return &Vector{0, 0, 1}, 0.0, 0.0
+	}
+	// u1 picks one of the six faces, what is left of it places the point on that face
+	t := u1 * area
+	face := 0
+	for ; face < 5 && t >= faces[face/2]; face++ {
+		t -= faces[face/2]
+	}
+	v := math.Min(t/faces[face/2], 1.0)
+	side := 1.0
+	if face%2 == 0 {
+		side = -1.0
+	}
+	var sample, normal *Vector
+	switch face / 2 {
+	case 0:
+		sample = &Vector{c.Min.X, c.Min.Y + v*size.Y, c.Min.Z + u2*size.Z}
+		normal = &Vector{side, 0, 0}
+	case 1:
+		sample = &Vector{c.Min.X + v*size.X, c.Min.Y, c.Min.Z + u2*size.Z}
+		normal = &Vector{0, side, 0}
+	default:
+		sample = &Vector{c.Min.X + v*size.X, c.Min.Y + u2*size.Y, c.Min.Z}
+		normal = &Vector{0, 0, side}
+	}
+	if side > 0.0 {
+		sample.X += normal.X * size.X
+		sample.Y += normal.Y * size.Y
+		sample.Z += normal.Z * size.Z
+	}
+	return sampleSurface(point, sample, normal, area)
+}
+
 func (c *Cube) initMinMax() {
 	c.Min = &Vector{
 		c.Position.X - c.Width/2.0,
@@ -626,6 +806,52 @@ func (y *Cylinder) GetNormal(point *Vector) *Vector {
 	return PQ.Sub(PQAA).Normalize()
 }
 
+// SampleLight picks a point on the side or one of the caps of the cylinder, each as likely as
+// its area.
+func (y *Cylinder) SampleLight(point *Vector, u1, u2 float64) (*Vector, float64, float64) {
+	side := 2.0 * math.Pi * y.Radius * y.Length
+	capArea := math.Pi * y.Radius * y.Radius
+	area := side + 2.0*capArea
+	if area <= 0.0 {
+		return y.Direction, 0.0, 0.0
+	}
+	t, b := orthonormalBasis(y.Direction)
+	phi := 2.0 * math.Pi * u2
+	radial := t.Mul(math.Cos(phi)).Add(b.Mul(math.Sin(phi)))
+
+	// u1 picks the side or a cap, what is left of it places the point there
+	pick := u1 * area
+	if pick < side {
+		along := y.Length * pick / side
+		sample := y.Position.Add(y.Direction.Mul(along)).Add(radial.Mul(y.Radius))
+		return sampleSurface(point, sample, radial, area)
+	}
+	pick -= side
+	center, normal := y.Position, y.Direction.Mul(-1.0)
+	if pick >= capArea {
+		pick -= capArea
+		center, normal = y.Position.Add(y.Direction.Mul(y.Length)), y.Direction
+	}
+	rad := y.Radius * math.Sqrt(math.Min(pick/capArea, 1.0))
+	return sampleSurface(point, center.Add(radial.Mul(rad)), normal, area)
+}
+
+// GetUV maps u around the cylinder and v along its length, from the end to the start.
+func (y *Cylinder) GetUV(point *Vector) (float64, float64) {
+	PQ := point.Sub(y.Position)
+	along := PQ.Dot(y.Direction)
+	t, b := orthonormalBasis(y.Direction)
+	u := 0.5 + math.Atan2(PQ.Dot(b), PQ.Dot(t))/(2.0*math.Pi)
+	return u, 1.0 - along/y.Length
+}
+
+func (y *Cylinder) GetTangent(point *Vector) (*Vector, *Vector) {
+	PQ := point.Sub(y.Position)
+	t, b := orthonormalBasis(y.Direction)
+	around := b.Mul(PQ.Dot(t)).Sub(t.Mul(PQ.Dot(b)))
+	return around.Normalize(), y.Direction.Mul(-1.0)
+}
+
 func (y *Cylinder) GetFurthest(point *Vector) float64 {
 	return y.Position.Sub(point).Module() + y.Length + y.Radius
 }
@@ -0,0 +1,146 @@
+package raycore
+
+import (
+	"math"
+	"math/rand"
+)
+
+// shadePBR shades a hit on a "pbr" material using a GGX microfacet specular lobe over a
+// Lambertian base. Rough reflections are blurred by sampling the GGX lobe Scene.GlossySamples
+// times, which for a roughness of zero reduces to a perfect mirror.
+func (rg *RayGun) shadePBR(r *Ray, material *Material, point, normal, view *Vector, depth int) (c Color) {
+	base := r.interColor
+	inside := normal.Dot(view) < 0.0
+	if inside {
+		normal = normal.Mul(-1.0)
+	}
+	NV := math.Max(normal.Dot(view), SMALL)
+	alpha := math.Max(material.Roughness*material.Roughness, 0.001)
+	f0 := Color{0.04, 0.04, 0.04}.Mul(1.0 - material.Metallic).Add(base.Mul(material.Metallic))
+	diffuse := base.Mul((1.0 - material.Metallic) * (1.0 - material.Transmission))
+
+	for _, light := range rg.Scene.LightList {
+		switch light.Kind {
+		case "ambient":
+			c = c.Add(light.Color.MulColor(diffuse))
+		case "point", "directional", "spot", "geometry":
+			if light.IsShape(r.interGrp, r.interObj) {
+				continue
+			}
+			lightDir, lightDist, lightColor := light.Illuminate(point)
+			NL := normal.Dot(lightDir)
+			if NL <= 0.0 || lightColor == (Color{}) {
+				continue
+			}
+			shadow := 1.0
+			if rg.Scene.CalcShadow {
+				shadow = rg.calcShadow(NewRay(point, lightDir), lightDist, r.interObj, r.interGrp)
+			}
+			half := lightDir.Add(view).Normalize()
+			NH := math.Max(normal.Dot(half), 0.0)
+			F := schlick(f0, math.Max(view.Dot(half), 0.0))
+			spec := ggxD(NH, alpha) * smithG(NV, NL, alpha) / (4.0 * NV * NL)
+			// Light colors are scaled by pi so a white base under a white light matches the
+			// brightness of the Phong model.
+			kd := Color{1.0 - F.R, 1.0 - F.G, 1.0 - F.B}.MulColor(diffuse)
+			c = c.Add(kd.Add(F.Mul(spec * math.Pi)).MulColor(lightColor).Mul(NL * shadow))
+		}
+	}
+	if env, ok := rg.Scene.Background.(*EnvironmentMap); ok && env.Samples > 0 {
+		c = c.Add(rg.environmentLight(env, point, normal, r).MulColor(diffuse))
+	}
+
+	if depth >= rg.Scene.TraceDepth {
+		return c
+	}
+
+	samples := rg.Scene.GlossySamples
+	if samples < 1 || material.Roughness == 0.0 {
+		samples = 1
+	}
+	var reflected, transmitted Color
+	for i := 0; i < samples; i++ {
+		half := normal
+		if material.Roughness > 0.0 {
+			half = sampleGGX(normal, alpha, rand.Float64(), rand.Float64())
+		}
+		VH := view.Dot(half)
+		if VH <= 0.0 {
+			continue
+		}
+		F := schlick(f0, VH)
+		dir := half.Mul(2 * VH).Sub(view)
+		if NL := normal.Dot(dir); NL > 0.0 {
+			weight := F
+			if material.Roughness > 0.0 {
+				weight = F.Mul(smithG(NV, NL, alpha) * VH / (NV * math.Max(normal.Dot(half), SMALL)))
+			}
+			ray := r.spawn(point.Add(dir.Mul(SMALL)), dir)
+			reflected = reflected.Add(rg.trace(ray, depth+1).MulColor(weight))
+		}
+		if material.Transmission > 0.0 {
+			eta := 1.0 / material.IOR
+			if inside {
+				eta = material.IOR
+			}
+			if dir := refract(view.Mul(-1.0), half, eta); dir != nil {
+				weight := Color{1.0 - F.R, 1.0 - F.G, 1.0 - F.B}.MulColor(base).Mul(material.Transmission * (1.0 - material.Metallic))
+				ray := r.spawn(point.Add(dir.Mul(SMALL)), dir)
+				transmitted = transmitted.Add(rg.trace(ray, depth+1).MulColor(weight))
+			}
+		}
+	}
+	return c.Add(reflected.Add(transmitted).Mul(1.0 / float64(samples)))
+}
+
+// ggxD is the GGX (Trowbridge-Reitz) normal distribution.
+func ggxD(NH, alpha float64) float64 {
+	a2 := alpha * alpha
+	d := NH*NH*(a2-1.0) + 1.0
+	return a2 / (math.Pi * d * d)
+}
+
+// smithG is the Smith shadowing-masking term for GGX.
+func smithG(NV, NL, alpha float64) float64 {
+	g1 := func(NX float64) float64 {
+		a2 := alpha * alpha
+		return 2.0 * NX / (NX + math.Sqrt(a2+(1.0-a2)*NX*NX))
+	}
+	return g1(NV) * g1(NL)
+}
+
+// schlick is Schlick's approximation of the Fresnel reflectance.
+func schlick(f0 Color, cosTheta float64) Color {
+	f := math.Pow(1.0-cosTheta, 5)
+	return Color{f0.R + (1.0-f0.R)*f, f0.G + (1.0-f0.G)*f, f0.B + (1.0-f0.B)*f}
+}
+
+// sampleGGX picks a microfacet normal around normal in proportion to the GGX distribution.
+func sampleGGX(normal *Vector, alpha, u1, u2 float64) *Vector {
+	phi := 2.0 * math.Pi * u1
+	cosTheta := math.Sqrt((1.0 - u2) / (1.0 + (alpha*alpha-1.0)*u2))
+	sinTheta := math.Sqrt(math.Max(0.0, 1.0-cosTheta*cosTheta))
+	t, b := orthonormalBasis(normal)
+	return t.Mul(sinTheta * math.Cos(phi)).Add(b.Mul(sinTheta * math.Sin(phi))).Add(normal.Mul(cosTheta)).Normalize()
+}
+
+// refract bends the incident direction through a surface with the given normal, eta is the
+// ratio of the refraction indices. It returns nil on total internal reflection.
+func refract(incident, normal *Vector, eta float64) *Vector {
+	cosI := -normal.Dot(incident)
+	k := 1.0 - eta*eta*(1.0-cosI*cosI)
+	if k < 0.0 {
+		return nil
+	}
+	return incident.Mul(eta).Add(normal.Mul(eta*cosI - math.Sqrt(k))).Normalize()
+}
+
+// orthonormalBasis returns two unit vectors perpendicular to n and to each other.
+func orthonormalBasis(n *Vector) (*Vector, *Vector) {
+	a := &Vector{1, 0, 0}
+	if math.Abs(n.X) > 0.9 {
+		a = &Vector{0, 1, 0}
+	}
+	t := a.Cross(n).Normalize()
+	return t, n.Cross(t).Normalize()
+}
@@ -0,0 +1,204 @@
+package raycore
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+)
+
+// Procedural is a texture that is calculated from the position on a surface instead of read
+// from an image. Kind is one of checker, grid, noise, fbm, marble or wood, and the pattern
+// blends between Color1 and Color2.
+// Space selects the coordinates the pattern is evaluated in: "uv" for the surface u,v of
+// the primitive, "object" for the position relative to the center of its group, or "world".
+// Scale is the number of repeats per unit. Param is the line width for a grid, the number of
+// octaves for fbm and the amount of turbulence for marble and wood, whose rings are around the
+// z axis.
+type Procedural struct {
+	Kind   string
+	Space  string
+	Scale  float64
+	Color1 Color
+	Color2 Color
+	Param  float64
+}
+
+// NewProcedural creates a procedural texture, a Param of zero selects the default for the kind.
+func NewProcedural(kind, space string, scale float64, color1, color2 Color, param float64) *Procedural {
+	p := &Procedural{
+		Kind:   kind,
+		Space:  space,
+		Scale:  scale,
+		Color1: color1,
+		Color2: color2,
+		Param:  param,
+	}
+	if p.Param == 0.0 {
+		switch kind {
+		case "grid":
+			p.Param = 0.05
+		case "fbm":
+			p.Param = 5
+		case "marble", "wood":
+			p.Param = 1.0
+		}
+	}
+	return p
+}
+
+func (p *Procedural) GetColor(h *Hit) Color {
+	var x, y, z float64
+	switch p.Space {
+	case "uv":
+		x, y = h.U, h.V
+	case "object":
+		x, y, z = h.Local.X, h.Local.Y, h.Local.Z
+	default:
+		x, y, z = h.Point.X, h.Point.Y, h.Point.Z
+	}
+	x, y, z = x*p.Scale, y*p.Scale, z*p.Scale
+
+	var t float64
+	switch p.Kind {
+	case "checker":
+		if int(math.Floor(x)+math.Floor(y)+math.Floor(z))&1 == 1 {
+			t = 1.0
+		}
+	case "grid":
+		coords := []float64{x, y, z}
+		need := 2 // in 3d a point must be on the edge of a cell
+		if p.Space == "uv" {
+			coords = coords[:2]
+			need = 1
+		}
+		lines := 0
+		for _, f := range coords {
+			f -= math.Floor(f)
+			if math.Min(f, 1.0-f) < 0.5*p.Param {
+				lines++
+			}
+		}
+		if lines >= need {
+			t = 1.0
+		}
+	case "noise":
+		t = 0.5 + 0.5*Noise(x, y, z)
+	case "fbm":
+		t = 0.5 + 0.5*FBM(x, y, z, int(p.Param))
+	case "marble":
+		t = 0.5 + 0.5*math.Sin(x+p.Param*4.0*Turbulence(x, y, z, 5))
+	case "wood":
+		rings := math.Sqrt(x*x+y*y) + p.Param*0.5*Noise(x, y, z)
+		t = rings - math.Floor(rings)
+	}
+	return p.Color1.Mul(1.0 - t).Add(p.Color2.Mul(t))
+}
+
+// isProceduralKind reports whether kind names a procedural texture.
+func isProceduralKind(kind string) bool {
+	switch kind {
+	case "checker", "grid", "noise", "fbm", "marble", "wood":
+		return true
+	}
+	return false
+}
+
+// ParseProcedural creates a procedural texture from the values following the channel on a
+// scene file pattern line: kind space scale r1 g1 b1 r2 g2 b2 [param]
+func ParseProcedural(line []string) *Procedural {
+	scale, _ := strconv.ParseFloat(line[2], 64)
+	param := 0.0
+	if len(line) > 9 {
+		param, _ = strconv.ParseFloat(line[9], 64)
+	}
+	return NewProcedural(line[0], line[1], scale, ParseColor(line[3:6]), ParseColor(line[6:9]), param)
+}
+
+// perm is the permutation table for Noise.
+var perm = func() [512]int {
+	var p [512]int
+	rnd := rand.New(rand.NewSource(1))
+	for i, v := range rnd.Perm(256) {
+		p[i] = v
+		p[i+256] = v
+	}
+	return p
+}()
+
+// Noise is Perlin's improved gradient noise, it returns a value in about [-1,1].
+func Noise(x, y, z float64) float64 {
+	fx, fy, fz := math.Floor(x), math.Floor(y), math.Floor(z)
+	X, Y, Z := int(fx)&255, int(fy)&255, int(fz)&255
+	x, y, z = x-fx, y-fy, z-fz
+	u, v, w := fade(x), fade(y), fade(z)
+
+	A := perm[X] + Y
+	AA := perm[A] + Z
+	AB := perm[A+1] + Z
+	B := perm[X+1] + Y
+	BA := perm[B] + Z
+	BB := perm[B+1] + Z
+
+	return lerp(w,
+		lerp(v,
+			lerp(u, grad(perm[AA], x, y, z), grad(perm[BA], x-1, y, z)),
+			lerp(u, grad(perm[AB], x, y-1, z), grad(perm[BB], x-1, y-1, z))),
+		lerp(v,
+			lerp(u, grad(perm[AA+1], x, y, z-1), grad(perm[BA+1], x-1, y, z-1)),
+			lerp(u, grad(perm[AB+1], x, y-1, z-1), grad(perm[BB+1], x-1, y-1, z-1))))
+}
+
+// FBM sums octaves of Noise, each at double the frequency and half the amplitude.
+func FBM(x, y, z float64, octaves int) float64 {
+	sum, amp, norm := 0.0, 1.0, 0.0
+	for i := 0; i < octaves; i++ {
+		sum += amp * Noise(x, y, z)
+		norm += amp
+		amp *= 0.5
+		x, y, z = x*2.0, y*2.0, z*2.0
+	}
+	if norm == 0.0 {
+		return 0.0
+	}
+	return sum / norm
+}
+
+// Turbulence is like FBM but sums the absolute value of the noise.
+func Turbulence(x, y, z float64, octaves int) float64 {
+	sum, amp := 0.0, 1.0
+	for i := 0; i < octaves; i++ {
+		sum += amp * math.Abs(Noise(x, y, z))
+		amp *= 0.5
+		x, y, z = x*2.0, y*2.0, z*2.0
+	}
+	return sum
+}
+
+func fade(t float64) float64 {
+	return t * t * t * (t*(t*6-15) + 10)
+}
+
+func lerp(t, a, b float64) float64 {
+	return a + t*(b-a)
+}
+
+func grad(hash int, x, y, z float64) float64 {
+	h := hash & 15
+	u := y
+	if h < 8 {
+		u = x
+	}
+	v := z
+	if h < 4 {
+		v = y
+	} else if h == 12 || h == 14 {
+		v = x
+	}
+	if h&1 != 0 {
+		u = -u
+	}
+	if h&2 != 0 {
+		v = -v
+	}
+	return u + v
+}
@@ -0,0 +1,58 @@
+package raycore
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Progress reports how far a render has got: the number of tiles Done out of Total, the
+// number of rays traced so far, the time since the render started and an estimate of the
+// time left.
+type Progress struct {
+	Done    int
+	Total   int
+	Rays    int64
+	Elapsed time.Duration
+	ETA     time.Duration
+}
+
+// progress counts the work done by a render and passes it on to the callback.
+type progress struct {
+	rays     int64 // first for 64 bit alignment of the atomic counter
+	lock     sync.Mutex
+	done     int
+	total    int
+	start    time.Time
+	callback func(Progress)
+}
+
+func newProgress(total int, callback func(Progress)) *progress {
+	return &progress{total: total, start: time.Now(), callback: callback}
+}
+
+// addRays counts rays traced, from any worker.
+func (p *progress) addRays(n int64) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.rays, n)
+}
+
+// tileDone counts a finished tile and calls the callback, one call at a time.
+func (p *progress) tileDone() {
+	if p.callback == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.done++
+	report := Progress{
+		Done:    p.done,
+		Total:   p.total,
+		Rays:    atomic.LoadInt64(&p.rays),
+		Elapsed: time.Since(p.start),
+	}
+	report.ETA = time.Duration(float64(report.Elapsed) * float64(p.total-p.done) / float64(p.done))
+	p.callback(report)
+}
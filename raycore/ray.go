@@ -9,6 +9,9 @@ type Ray struct {
 	interObj   int
 	interColor Color
 	a          float64
+	cone       float64 // width of the pixel footprint at the origin
+	spread     float64 // growth of the footprint per unit distance
+	layers     int     // see-through surfaces passed so far
 }
 
 func NewRay(origin, direction *Vector) *Ray {
@@ -22,3 +25,16 @@ func NewRay(origin, direction *Vector) *Ray {
 	r.a = r.direction.Dot(r.direction)
 	return r
 }
+
+// footprint returns the width of the pixel footprint at distance dist along the ray.
+func (r *Ray) footprint(dist float64) float64 {
+	return r.cone + dist*r.spread
+}
+
+// spawn creates a secondary ray from a point on this ray, which carries on the pixel footprint.
+func (r *Ray) spawn(origin, direction *Vector) *Ray {
+	s := NewRay(origin, direction)
+	s.cone = r.footprint(r.interDist)
+	s.spread = r.spread
+	return s
+}
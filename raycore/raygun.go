@@ -2,33 +2,48 @@ package raycore
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"image"
+	"image/color"
 	"io/ioutil"
 	"math"
+	"math/rand"
 	"os"
+	"sync"
+	"time"
 )
 
 const (
-	MAX_DIST = 1999999999
-	PI_180   = 0.017453292
-	SMALL    = 0.000000001
+	MAX_DIST   = 1999999999
+	MAX_LAYERS = 32 // see-through surfaces a ray passes before it stops
+	PI_180     = 0.017453292
+	SMALL      = 0.000000001
 )
 
+// RayGun renders a scene with a number of workers. Progress, if set, is called as each tile
+// of the image is finished. RemoteTimeout, if set, is the longest RenderRemote waits for a
+// server to render a tile. A RayGun can render its scene any number of times, such as after
+// moving the camera, but renders one at a time.
 type RayGun struct {
-	FileName   string
-	NumWorkers int
-	Scene      *Scene
-	Done       chan bool
-	Line       chan int
+	FileName      string
+	NumWorkers    int
+	Scene         *Scene
+	Progress      func(Progress)
+	RemoteTimeout time.Duration
+	progress      *progress
+	renderLock    sync.Mutex
 }
 
 func NewRayGun(filename string, numworkers int) (*RayGun, error) {
+	scene, err := LoadScene(filename)
+	if err != nil {
+		return nil, err
+	}
 	rg := &RayGun{
 		FileName:   filename,
 		NumWorkers: numworkers,
-		Scene:      NewSceneFromFile(filename),
-		Done:       make(chan bool, numworkers),
-		Line:       make(chan int),
+		Scene:      scene,
 	}
 	return rg, nil
 }
@@ -37,36 +52,127 @@ func NewRayGunFromScene(scene *Scene, numworkers int) (*RayGun, error) {
 	rg := &RayGun{
 		NumWorkers: numworkers,
 		Scene:      scene,
-		Done:       make(chan bool, numworkers),
-		Line:       make(chan int),
 	}
 	return rg, nil
 }
 
-// Render renders the scene and returns a jpeg that has been base64 encoded
+// Render renders the scene into Scene.Image.
 func (rg *RayGun) Render() {
-	for i := 0; i < rg.NumWorkers; i++ {
-		go rg.renderPixel(rg.Line, rg.Done)
+	rg.RenderContext(context.Background())
+}
+
+// RenderContext renders the scene into Scene.Image, stopping early if ctx is cancelled or
+// its deadline passes, in which case it returns ctx.Err() and the image holds the pixels that
+// were rendered. Only the Scene.Region of the image is rendered, from the samples in it and in
+// the border around it that the filter reaches; the pixels outside it keep what they held. It
+// returns an error without rendering if the scene has no camera.
+func (rg *RayGun) RenderContext(ctx context.Context) error {
+	rg.renderLock.Lock()
+	defer rg.renderLock.Unlock()
+
+	tiles, err := rg.prepare(1)
+	if err != nil {
+		return err
+	}
+	if rg.Scene.Adaptive != nil {
+		rg.Scene.SampleCount = image.NewGray(rg.Scene.Image.Bounds())
 	}
+	rg.renderTiles(ctx, tiles, func(x, y int) {
+		n := rg.samplePixel(x, y)
+		if rg.Scene.SampleCount != nil {
+			level := 255 * n / rg.Scene.Adaptive.Max
+			rg.Scene.SampleCount.SetGray(x, y, color.Gray{uint8(level)})
+		}
+	})
+	rg.resolve()
+	return ctx.Err()
+}
 
-	for y := rg.Scene.StartLine; y < rg.Scene.EndLine; y++ {
-		rg.Line <- y
+// RenderProgressive renders the scene in passes of one sample per pixel, adding to the image
+// with every pass. The samples of a pixel are the first ones of the scene's sampler, or of the
+// Sobol sequence for the grid samplers, which only spread a whole set of samples over the
+// pixel. It calls snapshot with the image after each pass; that is the image being rendered
+// into, so snapshot must copy it to keep it. It stops after the given number of passes, or
+// early with ctx.Err() if ctx is cancelled.
+func (rg *RayGun) RenderProgressive(ctx context.Context, passes int, snapshot func(pass int, img *image.RGBA)) error {
+	rg.renderLock.Lock()
+	defer rg.renderLock.Unlock()
+
+	tiles, err := rg.prepare(passes)
+	if err != nil {
+		return err
+	}
+	sampler := progressive(rg.Scene.Sampler)
+	seed := rand.Uint64()
+	scale := 1.0 / math.Sqrt(float64(passes))
+	for pass := 0; pass < passes && ctx.Err() == nil; pass++ {
+		rg.renderTiles(ctx, tiles, func(x, y int) {
+			rg.addSample(x, y, sampler.sample(pass, pixelShift(seed, x, y)), scale)
+		})
+		rg.resolve()
+		if snapshot != nil && ctx.Err() == nil {
+			snapshot(pass+1, rg.Scene.Image)
+		}
+	}
+	return ctx.Err()
+}
+
+// prepare starts a render of the given number of passes over the tiles it returns. The size
+// or camera may have changed since the last render.
+func (rg *RayGun) prepare(passes int) ([]image.Rectangle, error) {
+	bounds := image.Rect(0, 0, rg.Scene.ImgWidth, rg.Scene.ImgHeight)
+	if rg.Scene.Image == nil || rg.Scene.Image.Bounds() != bounds {
+		rg.Scene.Image = image.NewRGBA(bounds)
+	}
+	if err := rg.Scene.initCamera(); err != nil {
+		return nil, err
 	}
-	close(rg.Line)
+	rg.Scene.Frame = NewFramebuffer(rg.Scene.sampled())
+
+	tiles := rg.Scene.Tiles()
+	rg.progress = newProgress(len(tiles)*passes, rg.Progress)
+	return tiles, nil
+}
+
+// renderTiles hands the tiles to the workers, who call pixel for every pixel in them.
+func (rg *RayGun) renderTiles(ctx context.Context, tiles []image.Rectangle, pixel func(x, y int)) {
+	workers := maxInt(1, rg.NumWorkers)
+	queue := make(chan image.Rectangle)
+	done := make(chan bool, workers)
+	for i := 0; i < workers; i++ {
+		go rg.renderTile(ctx, queue, done, pixel)
+	}
+
+feed:
+	for _, tile := range tiles {
+		select {
+		case queue <- tile:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
 
 	// wait for all workers to finish
-	for i := 0; i < rg.NumWorkers; i++ {
-		<-rg.Done
+	for i := 0; i < workers; i++ {
+		<-done
 	}
 }
 
-func (rg *RayGun) calcShadow(r *Ray, collisionObj, collisionGrp int) float64 {
+// resolve writes the rendered region of the framebuffer to the image.
+func (rg *RayGun) resolve() {
+	rg.Scene.Frame.Resolve(rg.Scene.Image, rg.Scene.Region())
+}
+
+// calcShadow returns how much light reaches along r from a light that is lightDist away.
+func (rg *RayGun) calcShadow(r *Ray, lightDist float64, collisionObj, collisionGrp int) float64 {
+	rg.progress.addRays(1)
 	shadow := 1.0 //starts with no shadow
 	for g, grp := range rg.Scene.GroupList {
 		for i, obj := range grp.ObjectList {
 			r.interObj = -1
 			r.interGrp = -1
-			r.interDist = MAX_DIST
+			r.interDist = lightDist
 
 			grpCheck := true
 
@@ -74,15 +180,34 @@ func (rg *RayGun) calcShadow(r *Ray, collisionObj, collisionGrp int) float64 {
 				grpCheck = false
 			}
 
-			if obj.GetIntersect(r, g, i) && grpCheck && i != collisionObj {
-				shadow *= obj.GetMaterial().TransmitCol
+			if obj.GetIntersect(r, g, i) && grpCheck && !(g == collisionGrp && i == collisionObj) {
+				alpha := surfaceAlpha(obj, r.origin.Add(r.direction.Mul(r.interDist)), 0.0)
+				shadow *= (1.0 - alpha) + alpha*obj.GetMaterial().TransmitCol
 			}
 		}
 	}
 	return shadow
 }
 
-func (rg *RayGun) trace(r *Ray, depth int) (c Color) {
+func (rg *RayGun) trace(r *Ray, depth int) Color {
+	c := rg.shade(r, depth)
+	if r.interObj < 0 || r.layers >= MAX_LAYERS {
+		return c
+	}
+	obj := rg.Scene.GroupList[r.interGrp].ObjectList[r.interObj]
+	interPoint := r.origin.Add(r.direction.Mul(r.interDist))
+	if alpha := surfaceAlpha(obj, interPoint, r.footprint(r.interDist)); alpha < 1.0 {
+		// blend with what lies behind the surface
+		behind := r.spawn(interPoint.Add(r.direction.Mul(SMALL)), r.direction)
+		behind.layers = r.layers + 1
+		c = c.Mul(alpha).Add(rg.trace(behind, depth).Mul(1.0 - alpha))
+	}
+	return c
+}
+
+// shade returns the color seen along r from the surface it hits.
+func (rg *RayGun) shade(r *Ray, depth int) (c Color) {
+	rg.progress.addRays(1)
 	for g, grp := range rg.Scene.GroupList {
 		if !grp.HitBounds(r) {
 			continue
@@ -100,23 +225,49 @@ func (rg *RayGun) trace(r *Ray, depth int) (c Color) {
 		originBackV := r.direction.Mul(-1.0)
 		originBackV = originBackV.Normalize()
 		vNormal := rg.Scene.GroupList[r.interGrp].ObjectList[r.interObj].GetNormal(interPoint)
+		if material.HasMaps() {
+			u, v := obj.GetUV(interPoint)
+			hit := &Hit{
+				Point:     interPoint,
+				Local:     interPoint.Sub(rg.Scene.GroupList[r.interGrp].Center),
+				U:         u,
+				V:         v,
+				Footprint: uvFootprint(obj, interPoint, vNormal, r.footprint(r.interDist), u, v),
+			}
+			if material.DiffuseMap != nil {
+				r.interColor = r.interColor.MulColor(material.DiffuseMap.GetColor(hit))
+			}
+			if material.NormalMap != nil || material.BumpMap != nil {
+				vNormal = perturbNormal(obj, material, hit, vNormal, r.footprint(r.interDist))
+			}
+			material = material.At(hit)
+		}
+		c = material.Emitted()
+		if material.Model == "pbr" {
+			return c.Add(rg.shadePBR(r, material, interPoint, vNormal, originBackV, depth))
+		}
 		for _, light := range rg.Scene.LightList {
 			switch light.Kind {
 			case "ambient":
 				c = c.Add(light.Color)
-			case "point":
-				lightDir := light.Position.Sub(interPoint)
-				lightDir = lightDir.Normalize()
+			case "point", "directional", "spot", "geometry":
+				if light.IsShape(r.interGrp, r.interObj) {
+					continue
+				}
+				lightDir, lightDist, lightColor := light.Illuminate(interPoint)
+				NL := vNormal.Dot(lightDir)
+				if NL <= 0.0 || lightColor == (Color{}) {
+					continue
+				}
 				lightRay := NewRay(interPoint, lightDir)
 				shadow := 1.0
 				if rg.Scene.CalcShadow {
-					shadow = rg.calcShadow(lightRay, r.interObj, r.interGrp)
+					shadow = rg.calcShadow(lightRay, lightDist, r.interObj, r.interGrp)
 				}
-				NL := vNormal.Dot(lightDir)
 
 				if NL > 0.0 {
 					if material.DifuseCol > 0.0 { // ------- Difuso
-						difuseColor := light.Color.Mul(material.DifuseCol).Mul(NL)
+						difuseColor := lightColor.Mul(material.DifuseCol).Mul(NL)
 						difuseColor.R *= r.interColor.R * shadow
 						difuseColor.G *= r.interColor.G * shadow
 						difuseColor.B *= r.interColor.B * shadow
@@ -127,20 +278,23 @@ func (rg *RayGun) trace(r *Ray, depth int) (c Color) {
 						spec := originBackV.Dot(R)
 						if spec > 0.0 {
 							spec = material.SpecularCol * math.Pow(spec, material.SpecularD)
-							specularColor := light.Color.Mul(spec).Mul(shadow)
+							specularColor := lightColor.Mul(spec).Mul(shadow)
 							c = c.Add(specularColor)
 						}
 					}
 				}
 			}
 		}
+		if env, ok := rg.Scene.Background.(*EnvironmentMap); ok && env.Samples > 0 && material.DifuseCol > 0.0 {
+			c = c.Add(rg.environmentLight(env, interPoint, vNormal, r).Mul(material.DifuseCol))
+		}
 		if depth < rg.Scene.TraceDepth {
 			if material.ReflectionCol > 0.0 { // -------- Reflexion
 				T := originBackV.Dot(vNormal)
 				if T > 0.0 {
 					vDirRef := (vNormal.Mul(2).Mul(T)).Sub(originBackV)
 					vOffsetInter := interPoint.Add(vDirRef.Mul(SMALL))
-					rayoRef := NewRay(vOffsetInter, vDirRef)
+					rayoRef := r.spawn(vOffsetInter, vDirRef)
 					c = c.Add(rg.trace(rayoRef, depth+1.0).Mul(material.ReflectionCol))
 				}
 			}
@@ -161,44 +315,96 @@ func (rg *RayGun) trace(r *Ray, depth int) (c Color) {
 					par_sqrt := math.Sqrt(1 - (n1*n1/n2*n2)*(1-RN*RN))
 					refactDirV := incidentV.Add(vNormal.Mul(RN).Mul(n1 / n2)).Sub(vNormal.Mul(par_sqrt))
 					vOffsetInter := interPoint.Add(refactDirV.Mul(SMALL))
-					refractRay := NewRay(vOffsetInter, refactDirV)
+					refractRay := r.spawn(vOffsetInter, refactDirV)
 					c = c.Add(rg.trace(refractRay, depth+1.0).Mul(material.TransmitCol))
 				}
 			}
 		}
+	} else if rg.Scene.Background != nil {
+		c = rg.Scene.Background.GetColor(r.direction)
 	}
 	return c
 }
 
-func (rg *RayGun) renderPixel(line chan int, done chan bool) {
-	for y := range line { // 1: 1, 5: 2, 8: 3,
-		for x := 0; x < rg.Scene.ImgWidth; x++ {
-			var c Color
-			yo := y * rg.Scene.OverSampling
-			xo := x * rg.Scene.OverSampling
-			for i := 0; i < rg.Scene.OverSampling; i++ {
-				for j := 0; j < rg.Scene.OverSampling; j++ {
-					dir := &Vector{}
-					dir.X = float64(xo)*rg.Scene.Vhor.X + float64(yo)*rg.Scene.Vver.X + rg.Scene.Vp.X
-					dir.Y = float64(xo)*rg.Scene.Vhor.Y + float64(yo)*rg.Scene.Vver.Y + rg.Scene.Vp.Y
-					dir.Z = float64(xo)*rg.Scene.Vhor.Z + float64(yo)*rg.Scene.Vver.Z + rg.Scene.Vp.Z
-					dir = dir.Normalize()
-					r := NewRay(rg.Scene.CameraPos, dir)
-					c = c.Add(rg.trace(r, 1))
-					yo += 1
-				}
-				xo += 1
+// environmentLight estimates the diffuse light an environment map casts on a point by
+// sampling it in proportion to its brightness.
+func (rg *RayGun) environmentLight(env *EnvironmentMap, point, normal *Vector, r *Ray) Color {
+	var sum Color
+	for i := 0; i < env.Samples; i++ {
+		dir, col, pdf := env.Sample(rand.Float64(), rand.Float64())
+		NL := normal.Dot(dir)
+		if NL <= 0.0 || pdf <= 0.0 {
+			continue
+		}
+		shadow := 1.0
+		if rg.Scene.CalcShadow {
+			shadow = rg.calcShadow(NewRay(point, dir), MAX_DIST, r.interObj, r.interGrp)
+		}
+		sum = sum.Add(col.Mul(NL * shadow / (math.Pi * pdf)))
+	}
+	return sum.Mul(1.0 / float64(env.Samples)).MulColor(r.interColor)
+}
+
+// renderTile calls pixel for every pixel of the tiles it receives until the channel is
+// closed, skipping the rest once ctx is cancelled.
+func (rg *RayGun) renderTile(ctx context.Context, tiles chan image.Rectangle, done chan bool, pixel func(x, y int)) {
+	for tile := range tiles {
+		for y := tile.Min.Y; y < tile.Max.Y && ctx.Err() == nil; y++ {
+			for x := tile.Min.X; x < tile.Max.X; x++ {
+				pixel(x, y)
 			}
-			srq_oversampling := float64(rg.Scene.OverSampling * rg.Scene.OverSampling)
-			c.R /= srq_oversampling
-			c.G /= srq_oversampling
-			c.B /= srq_oversampling
-			rg.Scene.Image.SetRGBA(x, y, c.ToPixel())
+		}
+		if ctx.Err() == nil {
+			rg.progress.tileDone()
 		}
 	}
 	done <- true
 }
 
+// samplePixel traces the samples of the pixel x,y into the framebuffer and returns how many
+// it took. Oversampling N takes N×N samples. With adaptive sampling it takes samples until
+// the standard error of their mean brightness drops below the threshold.
+func (rg *RayGun) samplePixel(x, y int) int {
+	adaptive := rg.Scene.Adaptive
+	if adaptive == nil {
+		n := rg.Scene.OverSampling * rg.Scene.OverSampling
+		scale := 1.0 / float64(rg.Scene.OverSampling)
+		for _, s := range rg.Scene.Sampler.Samples(x, y, n) {
+			rg.addSample(x, y, s, scale)
+		}
+		return n
+	}
+
+	scale := 1.0 / math.Sqrt(float64(adaptive.Min))
+	var mean, m2 float64
+	n := 0
+	for _, s := range progressive(rg.Scene.Sampler).Samples(x, y, adaptive.Max) {
+		l := rg.addSample(x, y, s, scale).Luminance()
+		n++
+		d := l - mean
+		mean += d / float64(n)
+		m2 += d * (l - mean)
+		if n >= adaptive.Min && math.Sqrt(m2/float64(n-1)/float64(n)) <= adaptive.Threshold {
+			break
+		}
+	}
+	return n
+}
+
+// addSample traces the sample s of pixel x,y into the framebuffer and returns its color.
+// scale is the size of the sample relative to the pixel.
+func (rg *RayGun) addSample(x, y int, s Sample, scale float64) Color {
+	var c Color
+	sx, sy := float64(x)+s.X, float64(y)+s.Y
+	if r := rg.Scene.Camera.GetRay(sx, sy, s.U1, s.U2); r != nil {
+		r.cone *= scale
+		r.spread *= scale
+		c = rg.trace(r, 1)
+	}
+	rg.Scene.Frame.AddSample(sx, sy, c, rg.Scene.Filter)
+	return c
+}
+
 func (rg *RayGun) Write() {
 	reset := func(buffer *bytes.Buffer) {
 		buffer.Reset()
@@ -210,7 +416,7 @@ func (rg *RayGun) Write() {
 	for _, group := range rg.Scene.GroupList {
 		reset(buffer)
 		buffer.WriteString(fmt.Sprintf("var %s = ", group.Name))
-		fmt.Fprintf(buffer, "%#v\n", group.Name, group)
+		fmt.Fprintf(buffer, "%#v\n", group)
 		ioutil.WriteFile(path+group.Name+".go", []byte(buffer.String()), os.ModePerm)
 	}
 
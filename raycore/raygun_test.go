@@ -0,0 +1,134 @@
+package raycore
+
+import (
+	"context"
+	"image"
+	"testing"
+)
+
+// testScene is a red ball in front of the camera, lit from above.
+const testScene = testCamera + `size 32 24
+shadow false
+light 0 -10 10 1 1 1 point
+material 1 0 0 1.6 0 0 0 0 0
+group ball 0 0 0 true
+sphere 0 0 0 0 2
+`
+
+func TestRenderProgressive(t *testing.T) {
+	for _, sampler := range []string{"stratified", "halton"} {
+		scn, err := ParseScene(testScene + "sampler " + sampler + "\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rg, err := NewRayGunFromScene(scn, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var passes []int
+		err = rg.RenderProgressive(context.Background(), 4, func(pass int, img *image.RGBA) {
+			if img != rg.Scene.Image {
+				t.Errorf("%s: snapshot of another image", sampler)
+			}
+			passes = append(passes, pass)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(passes) != 4 || passes[0] != 1 || passes[3] != 4 {
+			t.Errorf("%s: snapshots after passes %v, want 1 to 4", sampler, passes)
+		}
+		if c := rg.Scene.Image.RGBAAt(16, 12); c.R == 0 || c.G != 0 {
+			t.Errorf("%s: center pixel %v, want the red ball", sampler, c)
+		}
+	}
+}
+
+func TestRenderProgressiveCancel(t *testing.T) {
+	scn, err := ParseScene(testScene)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rg, _ := NewRayGunFromScene(scn, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	last := 0
+	err = rg.RenderProgressive(ctx, 8, func(pass int, img *image.RGBA) {
+		last = pass
+		if pass == 2 {
+			cancel()
+		}
+	})
+	if err != context.Canceled || last != 2 {
+		t.Errorf("cancelled after pass %d with error %v", last, err)
+	}
+}
+
+func TestRenderContextCancel(t *testing.T) {
+	// the ball fills the image, so every rendered pixel is red
+	scn, err := ParseScene(testScene + "sphere 0 0 0 0 8\ntiles 8 row\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rg, _ := NewRayGunFromScene(scn, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rg.Progress = func(p Progress) {
+		if p.Done == 1 {
+			cancel()
+		}
+	}
+	if err := rg.RenderContext(ctx); err != context.Canceled {
+		t.Fatalf("cancelled render returned %v", err)
+	}
+	img := rg.Scene.Image
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if c := img.RGBAAt(x, y); c.R == 0 {
+				t.Fatalf("pixel %d,%d of the first tile is %v, want it rendered", x, y, c)
+			}
+		}
+	}
+	if c := img.RGBAAt(31, 23); c.R != 0 {
+		t.Errorf("pixel of the last tile is %v, want it not rendered", c)
+	}
+}
+
+func TestRenderAfterChanges(t *testing.T) {
+	scn, err := ParseScene(testScene)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rg, _ := NewRayGunFromScene(scn, 2)
+	red := func() int {
+		n := 0
+		img := rg.Scene.Image
+		for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+			for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+				if img.RGBAAt(x, y).R > 0 {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	if err := rg.RenderContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	near := red()
+
+	// a new size and a camera four times as far away
+	scn.ImgWidth, scn.ImgHeight = 48, 16
+	scn.CameraPos = &Vector{0, -40, 0}
+	if err := rg.RenderContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if b := rg.Scene.Image.Bounds(); b != image.Rect(0, 0, 48, 16) {
+		t.Fatalf("image bounds %v after resizing, want 48x16", b)
+	}
+	if c := rg.Scene.Image.RGBAAt(24, 8); c.R == 0 {
+		t.Errorf("center pixel %v, want the red ball", c)
+	}
+	if far := red(); far == 0 || far*4 > near {
+		t.Errorf("ball covers %d pixels from afar, %d from near", far, near)
+	}
+}
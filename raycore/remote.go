@@ -0,0 +1,335 @@
+package raycore
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"net"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	remoteTileSize = 64 // tile size for remote renders of scenes that render by line
+	remoteRetries  = 3  // failures in a row before a render server is given up
+	remoteScenes   = 4  // scenes a render server keeps loaded
+	remoteWait     = time.Second
+	remoteDial     = 5 * time.Second
+	remoteTimeout  = 10 * time.Minute // default longest wait for a render server to answer
+)
+
+// RemoteScene is a scene shipped to a render server: the text of its scene file and the
+// named camera to render it from, or none for the scene's own camera. Image files named in
+// the scene are read by the server, relative to its working directory.
+type RemoteScene struct {
+	Text   string
+	Camera string
+}
+
+// RemoteTile asks a render server for a tile of a scene it has loaded.
+type RemoteTile struct {
+	Scene string
+	Tile  image.Rectangle
+}
+
+// RemoteResult is a rendered tile, with its pixels laid out as in an image.RGBA of the tile,
+// and the number of rays traced to render it.
+type RemoteResult struct {
+	Pix  []uint8
+	Rays int64
+}
+
+// RenderServer renders tiles of scenes for RenderRemote over net/rpc. It renders one tile
+// at a time, with NumWorkers workers, and keeps the last few scenes it loaded. It reads any
+// scene it is sent, with the image files it names, so it must only be reachable by the
+// machines rendering with it.
+type RenderServer struct {
+	NumWorkers int
+	lock       sync.Mutex
+	scenes     map[string]*RayGun
+	loaded     []string // the ids of the scenes, the most recently loaded last
+}
+
+func NewRenderServer(numworkers int) *RenderServer {
+	return &RenderServer{
+		NumWorkers: numworkers,
+		scenes:     make(map[string]*RayGun),
+	}
+}
+
+// Serve answers render requests on the connections made to l, rendering with numworkers
+// workers, until l is closed.
+func Serve(l net.Listener, numworkers int) error {
+	server := rpc.NewServer()
+	if err := server.Register(NewRenderServer(numworkers)); err != nil {
+		return err
+	}
+	server.Accept(l)
+	return nil
+}
+
+// Load reads a scene and sets id to the name to render its tiles by. A scene that is already
+// loaded is not read again. Loading a scene unloads the least recently loaded one once there
+// are more than remoteScenes. A scene that makes the parser panic is an error.
+func (s *RenderServer) Load(scene *RemoteScene, id *string) (err error) {
+	defer recoverError(&err)
+	sum := sha1.Sum([]byte(scene.Camera + "\n" + scene.Text))
+	*id = hex.EncodeToString(sum[:])
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.scenes[*id] != nil {
+		s.use(*id)
+		return nil
+	}
+	scn, err := ParseScene(scene.Text)
+	if err != nil {
+		return err
+	}
+	if scene.Camera != "" {
+		if err := scn.UseCamera(scene.Camera); err != nil {
+			return err
+		}
+	}
+	rg, err := NewRayGunFromScene(scn, s.NumWorkers)
+	if err != nil {
+		return err
+	}
+	s.scenes[*id] = rg
+	s.use(*id)
+	if len(s.loaded) > remoteScenes {
+		delete(s.scenes, s.loaded[0])
+		s.loaded = s.loaded[1:]
+	}
+	return nil
+}
+
+// use moves id to the end of the loaded scenes.
+func (s *RenderServer) use(id string) {
+	for i, loaded := range s.loaded {
+		if loaded == id {
+			s.loaded = append(s.loaded[:i], s.loaded[i+1:]...)
+			break
+		}
+	}
+	s.loaded = append(s.loaded, id)
+}
+
+// Render renders a tile of a loaded scene. As a crop window, the tile gets the samples of the
+// border around it that the filter reaches, as it would in a render of the whole image.
+func (s *RenderServer) Render(args *RemoteTile, result *RemoteResult) (err error) {
+	defer recoverError(&err)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	rg := s.scenes[args.Scene]
+	if rg == nil {
+		return fmt.Errorf("unknown scene %s", args.Scene)
+	}
+	scn := rg.Scene
+	if args.Tile.Empty() || !args.Tile.In(image.Rect(0, 0, scn.ImgWidth, scn.ImgHeight)) {
+		return fmt.Errorf("tile %v outside the image", args.Tile)
+	}
+
+	scn.Crop, scn.CropOnly = args.Tile, false
+	if err := rg.RenderContext(context.Background()); err != nil {
+		return err
+	}
+
+	tile := image.NewRGBA(args.Tile)
+	draw.Draw(tile, args.Tile, scn.Image, args.Tile.Min, draw.Src)
+	result.Pix = tile.Pix
+	result.Rays = atomic.LoadInt64(&rg.progress.rays)
+	return nil
+}
+
+// recoverError turns a panic into an error in err, as net/rpc lets a panicking method take
+// down the whole server.
+func recoverError(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("panic: %v", r)
+	}
+}
+
+// RenderRemote renders the scene into Scene.Image on the render servers at addrs instead of
+// locally. The servers are sent scene, which must hold the text the RayGun's scene was read
+// from. The tiles of the Scene.Region are handed out to the servers as they finish the
+// previous ones. A tile a server fails to render, or takes longer than RemoteTimeout over,
+// goes back to be rendered by any server, and a server is given up after failing a few times
+// in a row. RenderRemote returns an error if every server was given up before the image was
+// done, or ctx.Err() if ctx is cancelled.
+func (rg *RayGun) RenderRemote(ctx context.Context, scene *RemoteScene, addrs []string) error {
+	rg.renderLock.Lock()
+	defer rg.renderLock.Unlock()
+
+	bounds := image.Rect(0, 0, rg.Scene.ImgWidth, rg.Scene.ImgHeight)
+	if rg.Scene.Image == nil || rg.Scene.Image.Bounds() != bounds {
+		rg.Scene.Image = image.NewRGBA(bounds)
+	}
+	rg.Scene.SampleCount = nil
+	size := rg.Scene.TileSize
+	if size <= 0 {
+		size = remoteTileSize
+	}
+	tiles := rg.Scene.tiles(rg.Scene.Region(), size)
+	rg.progress = newProgress(len(tiles), rg.Progress)
+
+	r := &remoteRender{
+		rg:       rg,
+		scene:    scene,
+		timeout:  rg.RemoteTimeout,
+		pending:  make(chan image.Rectangle, len(tiles)),
+		finished: make(chan struct{}),
+		left:     len(tiles),
+	}
+	if r.timeout <= 0 {
+		r.timeout = remoteTimeout
+	}
+	for _, tile := range tiles {
+		r.pending <- tile
+	}
+	if r.left == 0 {
+		close(r.finished)
+	}
+
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			r.work(ctx, addr)
+		}(addr)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if r.left > 0 {
+		return fmt.Errorf("%d tiles not rendered: %v", r.left, r.err)
+	}
+	return nil
+}
+
+// remoteRender hands out the tiles of a remote render. A tile is either pending or held by
+// the server rendering it.
+type remoteRender struct {
+	rg       *RayGun
+	scene    *RemoteScene
+	timeout  time.Duration
+	pending  chan image.Rectangle
+	finished chan struct{} // closed when all tiles are done
+	lock     sync.Mutex
+	left     int
+	err      error // the last failure of a server
+}
+
+// work renders tiles on the server at addr until there are none left, connecting again
+// after a failure until the server has failed remoteRetries times in a row.
+func (r *remoteRender) work(ctx context.Context, addr string) {
+	for failures := 0; failures < remoteRetries; {
+		if failures > 0 {
+			select {
+			case <-time.After(remoteWait):
+			case <-r.finished:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+		done, err := r.session(ctx, addr)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		if done > 0 {
+			failures = 0
+		}
+		failures++
+		r.lock.Lock()
+		r.err = fmt.Errorf("%s: %v", addr, err)
+		r.lock.Unlock()
+	}
+}
+
+// session connects to the server at addr and renders tiles on it until there are none left.
+// It returns the number of tiles rendered and the failure that ended it early.
+func (r *remoteRender) session(ctx context.Context, addr string) (int, error) {
+	conn, err := net.DialTimeout("tcp", addr, remoteDial)
+	if err != nil {
+		return 0, err
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+
+	var id string
+	if err := r.call(ctx, client, "RenderServer.Load", r.scene, &id); err != nil {
+		if err == errFinished {
+			err = nil
+		}
+		return 0, err
+	}
+	done := 0
+	for {
+		var tile image.Rectangle
+		select {
+		case tile = <-r.pending:
+		case <-r.finished:
+			return done, nil
+		case <-ctx.Done():
+			return done, nil
+		}
+
+		var result RemoteResult
+		err := r.call(ctx, client, "RenderServer.Render", &RemoteTile{Scene: id, Tile: tile}, &result)
+		if err == nil && len(result.Pix) != 4*tile.Dx()*tile.Dy() {
+			err = fmt.Errorf("tile %v has %d bytes", tile, len(result.Pix))
+		}
+		if err != nil {
+			r.pending <- tile
+			return done, err
+		}
+		r.tileDone(tile, &result)
+		done++
+	}
+}
+
+// tileDone copies a rendered tile into the image.
+func (r *remoteRender) tileDone(tile image.Rectangle, result *RemoteResult) {
+	src := &image.RGBA{Pix: result.Pix, Stride: 4 * tile.Dx(), Rect: tile}
+	draw.Draw(r.rg.Scene.Image, tile, src, tile.Min, draw.Src)
+	r.rg.progress.addRays(result.Rays)
+	r.rg.progress.tileDone()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.left--
+	if r.left == 0 {
+		close(r.finished)
+	}
+}
+
+// errFinished ends a call that is no longer needed as all tiles are done.
+var errFinished = errors.New("all tiles rendered")
+
+// call calls method on the server, giving up if the server does not answer within the
+// timeout, if all tiles are done, or if ctx is cancelled.
+func (r *remoteRender) call(ctx context.Context, client *rpc.Client, method string, args, reply interface{}) error {
+	timer := time.NewTimer(r.timeout)
+	defer timer.Stop()
+	c := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-c.Done:
+		return c.Error
+	case <-timer.C:
+		return fmt.Errorf("%s: no answer after %v", method, r.timeout)
+	case <-r.finished:
+		return errFinished
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
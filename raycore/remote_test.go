@@ -0,0 +1,188 @@
+package raycore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const remoteTestScene = testScene + "filter gaussian\ntiles 8\n"
+
+// testListener is a loopback listener that can cut off the connections it accepted.
+type testListener struct {
+	net.Listener
+	lock  sync.Mutex
+	conns []net.Conn
+}
+
+func (l *testListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.lock.Lock()
+		l.conns = append(l.conns, c)
+		l.lock.Unlock()
+	}
+	return c, err
+}
+
+// kill closes the listener and the connections it accepted, as if the server died.
+func (l *testListener) kill() {
+	l.Close()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, c := range l.conns {
+		c.Close()
+	}
+}
+
+func listen(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// startServer serves renders on a loopback port.
+func startServer(t *testing.T) *testListener {
+	l := &testListener{Listener: listen(t)}
+	go Serve(l, 2)
+	t.Cleanup(l.kill)
+	return l
+}
+
+func renderLocal(t *testing.T, text string) *image.RGBA {
+	scn, err := ParseScene(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rg, _ := NewRayGunFromScene(scn, 2)
+	if err := rg.RenderContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return scn.Image
+}
+
+func newRemoteRayGun(t *testing.T, text string) *RayGun {
+	scn, err := ParseScene(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rg, _ := NewRayGunFromScene(scn, 1)
+	return rg
+}
+
+func TestRenderRemote(t *testing.T) {
+	want := renderLocal(t, remoteTestScene)
+
+	tests := []struct {
+		name string
+		kill bool
+	}{
+		{"two servers", false},
+		{"one server dies", true},
+	}
+	for _, tt := range tests {
+		rg := newRemoteRayGun(t, remoteTestScene)
+		a, b := startServer(t), startServer(t)
+		var once sync.Once
+		if tt.kill {
+			rg.Progress = func(p Progress) {
+				once.Do(a.kill)
+			}
+		}
+		addrs := []string{a.Addr().String(), b.Addr().String()}
+		if err := rg.RenderRemote(context.Background(), &RemoteScene{Text: remoteTestScene}, addrs); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(rg.Scene.Image.Pix, want.Pix) {
+			t.Errorf("%s: remote render differs from the local one", tt.name)
+		}
+	}
+}
+
+func TestRenderRemoteTimeout(t *testing.T) {
+	silent := listen(t) // accepts connections but never answers
+
+	rg := newRemoteRayGun(t, remoteTestScene)
+	rg.RemoteTimeout = 50 * time.Millisecond
+	err := rg.RenderRemote(context.Background(), &RemoteScene{Text: remoteTestScene}, []string{silent.Addr().String()})
+	if err == nil || !strings.Contains(err.Error(), "no answer") {
+		t.Errorf("render on a silent server: error %v, want no answer", err)
+	}
+
+	// with a working server the render does not wait for the silent one
+	rg.RemoteTimeout = time.Minute
+	start := time.Now()
+	addrs := []string{silent.Addr().String(), startServer(t).Addr().String()}
+	if err := rg.RenderRemote(context.Background(), &RemoteScene{Text: remoteTestScene}, addrs); err != nil {
+		t.Error(err)
+	}
+	if d := time.Since(start); d > 30*time.Second {
+		t.Errorf("render took %v", d)
+	}
+}
+
+func TestRenderServerLoad(t *testing.T) {
+	s := NewRenderServer(1)
+	var ids []string
+	for i := 0; i <= remoteScenes; i++ {
+		var id string
+		text := fmt.Sprintf("%ssize %d 8\n", testCamera, 8+i)
+		if err := s.Load(&RemoteScene{Text: text}, &id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if len(s.scenes) != remoteScenes || s.scenes[ids[0]] != nil || s.scenes[ids[remoteScenes]] == nil {
+		t.Errorf("%d scenes loaded, want the last %d", len(s.scenes), remoteScenes)
+	}
+
+	var id string
+	if err := s.Load(&RemoteScene{Text: "size 8 8\n"}, &id); err == nil {
+		t.Error("scene without a camera loaded")
+	}
+	if err := s.Render(&RemoteTile{Scene: ids[0], Tile: image.Rect(0, 0, 8, 8)}, &RemoteResult{}); err == nil {
+		t.Error("unloaded scene rendered")
+	}
+}
+
+func TestRenderServerSurvivesBadScene(t *testing.T) {
+	client, err := rpc.Dial("tcp", startServer(t).Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var id string
+	err = client.Call("RenderServer.Load", &RemoteScene{Text: testCamera + "size 8\n"}, &id)
+	if err == nil || !strings.Contains(err.Error(), "panic") {
+		t.Errorf("loading a malformed scene: error %v, want the panic", err)
+	}
+	err = client.Call("RenderServer.Render", &RemoteTile{Scene: "none", Tile: image.Rect(0, 0, 1, 1)}, &RemoteResult{})
+	if err == nil {
+		t.Error("unknown scene rendered")
+	}
+
+	// the server still renders
+	if err := client.Call("RenderServer.Load", &RemoteScene{Text: remoteTestScene}, &id); err != nil {
+		t.Fatal(err)
+	}
+	var result RemoteResult
+	tile := image.Rect(8, 8, 16, 16)
+	if err := client.Call("RenderServer.Render", &RemoteTile{Scene: id, Tile: tile}, &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Pix) != 4*tile.Dx()*tile.Dy() {
+		t.Errorf("tile of %d bytes", len(result.Pix))
+	}
+}
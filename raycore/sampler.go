@@ -0,0 +1,228 @@
+package raycore
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+)
+
+// Sample is a point in a pixel, with X and Y the offset from its top left corner in [0,1),
+// and U1 and U2 in [0,1) for sampling the camera lens.
+type Sample struct {
+	X, Y   float64
+	U1, U2 float64
+}
+
+// Sampler places the samples of a pixel. Samples returns n samples for the pixel x,y. The
+// Halton and Sobol samplers give them in an order where any first few are already spread over
+// the pixel, the grid samplers only spread all n of them.
+type Sampler interface {
+	Samples(x, y, n int) []Sample
+}
+
+// StratifiedSampler places the samples at the centers of a grid of cells over the pixel, the
+// same in every pixel.
+type StratifiedSampler struct{}
+
+func (s *StratifiedSampler) Samples(x, y, n int) []Sample {
+	return gridSamples(n, func() float64 { return 0.5 })
+}
+
+// JitteredSampler places each sample at a random point in its cell of a grid over the pixel.
+type JitteredSampler struct{}
+
+func (s *JitteredSampler) Samples(x, y, n int) []Sample {
+	return gridSamples(n, rand.Float64)
+}
+
+// gridSamples places n samples in a grid of n cells over the pixel, one in each cell, with
+// offset giving the position in a cell. The grid is as near to square as n allows, so a count
+// that is not square has more columns than rows. The cells are visited in random order.
+func gridSamples(n int, offset func() float64) []Sample {
+	if n <= 0 {
+		return nil
+	}
+	rows := int(math.Sqrt(float64(n)))
+	for n%rows != 0 {
+		rows--
+	}
+	cols := n / rows
+	samples := make([]Sample, n)
+	for j, i := range rand.Perm(n) {
+		samples[j] = Sample{
+			X:  (float64(i%cols) + offset()) / float64(cols),
+			Y:  (float64(i/cols) + offset()) / float64(rows),
+			U1: rand.Float64(),
+			U2: rand.Float64(),
+		}
+	}
+	return samples
+}
+
+// HaltonSampler takes the samples from the Halton sequence in bases 2, 3, 5 and 7, shifted by
+// a random amount in every pixel so that neighbouring pixels do not share a pattern.
+type HaltonSampler struct{}
+
+func (s *HaltonSampler) Samples(x, y, n int) []Sample {
+	return sequenceSamples(s, n)
+}
+
+func (s *HaltonSampler) sample(i int, shift [4]uint32) Sample {
+	return Sample{
+		X:  wrapUnit(radicalInverse(i+1, 2) + float64(shift[0])/(1<<32)),
+		Y:  wrapUnit(radicalInverse(i+1, 3) + float64(shift[1])/(1<<32)),
+		U1: wrapUnit(radicalInverse(i+1, 5) + float64(shift[2])/(1<<32)),
+		U2: wrapUnit(radicalInverse(i+1, 7) + float64(shift[3])/(1<<32)),
+	}
+}
+
+// radicalInverse mirrors the digits of i in base around the decimal point.
+func radicalInverse(i, base int) float64 {
+	inv := 1.0 / float64(base)
+	f, r := inv, 0.0
+	for ; i > 0; i /= base {
+		r += f * float64(i%base)
+		f *= inv
+	}
+	return r
+}
+
+func wrapUnit(f float64) float64 {
+	return f - math.Floor(f)
+}
+
+// SobolSampler takes the samples from the first four dimensions of the Sobol sequence,
+// scrambled by a random bit pattern in every pixel.
+type SobolSampler struct{}
+
+// sobolDirections are the direction numbers of the first four Sobol dimensions, from the
+// primitive polynomials and initial numbers of Joe and Kuo.
+var sobolDirections = func() [4][32]uint32 {
+	var v [4][32]uint32
+	polys := []struct {
+		s, a uint
+		m    []uint32
+	}{
+		{1, 0, []uint32{1}},
+		{2, 1, []uint32{1, 3}},
+		{3, 1, []uint32{1, 3, 1}},
+	}
+	for k := uint(0); k < 32; k++ {
+		v[0][k] = 1 << (31 - k)
+	}
+	for d, p := range polys {
+		dir := &v[d+1]
+		for k := uint(0); k < 32; k++ {
+			if k < p.s {
+				dir[k] = p.m[k] << (31 - k)
+				continue
+			}
+			dir[k] = dir[k-p.s] ^ (dir[k-p.s] >> p.s)
+			for j := uint(1); j < p.s; j++ {
+				if (p.a>>(p.s-1-j))&1 == 1 {
+					dir[k] ^= dir[k-j]
+				}
+			}
+		}
+	}
+	return v
+}()
+
+func (s *SobolSampler) Samples(x, y, n int) []Sample {
+	return sequenceSamples(s, n)
+}
+
+func (s *SobolSampler) sample(i int, scramble [4]uint32) Sample {
+	var f [4]float64
+	for d := range f {
+		bits := scramble[d]
+		for k := 0; i>>uint(k) > 0; k++ {
+			if (i>>uint(k))&1 == 1 {
+				bits ^= sobolDirections[d][k]
+			}
+		}
+		f[d] = float64(bits) / (1 << 32)
+	}
+	return Sample{X: f[0], Y: f[1], U1: f[2], U2: f[3]}
+}
+
+// sequenceSampler is a Sampler that takes the samples of a pixel from a sequence, so that
+// they can be taken one at a time. sample returns sample i of the sequence, shifted or
+// scrambled by shift.
+type sequenceSampler interface {
+	Sampler
+	sample(i int, shift [4]uint32) Sample
+}
+
+// sequenceSamples returns the first n samples of the sequence of s with a random shift.
+func sequenceSamples(s sequenceSampler, n int) []Sample {
+	var shift [4]uint32
+	for d := range shift {
+		shift[d] = rand.Uint32()
+	}
+	samples := make([]Sample, n)
+	for i := range samples {
+		samples[i] = s.sample(i, shift)
+	}
+	return samples
+}
+
+// pixelShift returns the shift of the sequence in the pixel x,y for a render with the given
+// seed, the same every time it is asked for.
+func pixelShift(seed uint64, x, y int) [4]uint32 {
+	h := seed ^ uint64(uint32(x))<<32 ^ uint64(uint32(y))
+	var shift [4]uint32
+	for d := range shift {
+		// splitmix64
+		h += 0x9e3779b97f4a7c15
+		z := (h ^ h>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		shift[d] = uint32((z ^ z>>31) >> 32)
+	}
+	return shift
+}
+
+// ParseSampler returns the sampler with the given name: stratified, jittered, halton or sobol.
+func ParseSampler(name string) (Sampler, error) {
+	switch name {
+	case "stratified":
+		return &StratifiedSampler{}, nil
+	case "jittered":
+		return &JitteredSampler{}, nil
+	case "halton":
+		return &HaltonSampler{}, nil
+	case "sobol":
+		return &SobolSampler{}, nil
+	}
+	return nil, fmt.Errorf("unknown sampler %s", name)
+}
+
+// progressive returns s if its first samples are spread over the pixel, or else a Sobol
+// sampler.
+func progressive(s Sampler) sequenceSampler {
+	if seq, ok := s.(sequenceSampler); ok {
+		return seq
+	}
+	return &SobolSampler{}
+}
+
+// AdaptiveSampling takes between Min and Max samples per pixel, stopping once the standard
+// error of the mean brightness of the samples is below Threshold. As it may stop after any
+// number of samples, it takes them from the Sobol sequence unless the scene uses Halton.
+type AdaptiveSampling struct {
+	Min       int
+	Max       int
+	Threshold float64
+}
+
+// ParseAdaptive parses the values following adaptive on a scene file line: min max threshold
+func ParseAdaptive(line []string) *AdaptiveSampling {
+	a := &AdaptiveSampling{}
+	a.Min, _ = strconv.Atoi(line[0])
+	a.Max, _ = strconv.Atoi(line[1])
+	a.Threshold, _ = strconv.ParseFloat(line[2], 64)
+	a.Min = maxInt(a.Min, 2)
+	a.Max = maxInt(a.Max, a.Min)
+	return a
+}
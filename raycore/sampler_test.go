@@ -0,0 +1,113 @@
+package raycore
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseSampler(t *testing.T) {
+	tests := []struct {
+		name string
+		want Sampler
+	}{
+		{"stratified", &StratifiedSampler{}},
+		{"jittered", &JitteredSampler{}},
+		{"halton", &HaltonSampler{}},
+		{"sobol", &SobolSampler{}},
+	}
+	for _, tt := range tests {
+		got, err := ParseSampler(tt.name)
+		if err != nil {
+			t.Errorf("ParseSampler(%q): %v", tt.name, err)
+			continue
+		}
+		if fmt.Sprintf("%T", got) != fmt.Sprintf("%T", tt.want) {
+			t.Errorf("ParseSampler(%q) = %T, want %T", tt.name, got, tt.want)
+		}
+	}
+	if _, err := ParseSampler("random"); err == nil {
+		t.Error("unknown sampler parsed")
+	}
+}
+
+func TestParseAdaptive(t *testing.T) {
+	tests := []struct {
+		line string
+		want AdaptiveSampling
+	}{
+		{"4 64 0.01", AdaptiveSampling{4, 64, 0.01}},
+		{"1 16 0.05", AdaptiveSampling{2, 16, 0.05}},
+		{"8 4 0.1", AdaptiveSampling{8, 8, 0.1}},
+		{"0 0 0", AdaptiveSampling{2, 2, 0}},
+	}
+	for _, tt := range tests {
+		if got := ParseAdaptive(strings.Fields(tt.line)); *got != tt.want {
+			t.Errorf("ParseAdaptive(%q) = %+v, want %+v", tt.line, *got, tt.want)
+		}
+	}
+}
+
+func TestGridSamplesCoverCells(t *testing.T) {
+	tests := []struct {
+		n, cols, rows int
+	}{
+		{1, 1, 1},
+		{4, 2, 2},
+		{6, 3, 2},
+		{7, 7, 1},
+		{8, 4, 2},
+		{9, 3, 3},
+		{10, 5, 2},
+		{12, 4, 3},
+	}
+	for _, sampler := range []Sampler{&StratifiedSampler{}, &JitteredSampler{}} {
+		for _, tt := range tests {
+			seen := make(map[int]bool)
+			for _, s := range sampler.Samples(0, 0, tt.n) {
+				cell := int(s.Y*float64(tt.rows))*tt.cols + int(s.X*float64(tt.cols))
+				if seen[cell] {
+					t.Errorf("%T n %d: two samples in cell %d", sampler, tt.n, cell)
+				}
+				seen[cell] = true
+			}
+			if len(seen) != tt.n {
+				t.Errorf("%T n %d: %d cells sampled, want %d", sampler, tt.n, len(seen), tt.n)
+			}
+		}
+	}
+}
+
+func TestSobolPrefixes(t *testing.T) {
+	// every first 4 samples are in different quadrants, and every first 16 in different
+	// cells of a 4x4 grid
+	samples := (&SobolSampler{}).Samples(0, 0, 16)
+	for _, k := range []int{2, 4} {
+		seen := make(map[int]bool)
+		for _, s := range samples[:k*k] {
+			seen[int(s.Y*float64(k))*k+int(s.X*float64(k))] = true
+		}
+		if len(seen) != k*k {
+			t.Errorf("first %d samples cover %d of the %dx%d cells", k*k, len(seen), k, k)
+		}
+	}
+}
+
+func TestPassSamples(t *testing.T) {
+	// a progressive render takes the samples of a pixel one per pass, the same shift each
+	// pass, so they are spread as much as those of one Samples call
+	if pixelShift(7, 3, 4) != pixelShift(7, 3, 4) || pixelShift(7, 3, 4) == pixelShift(7, 4, 3) {
+		t.Error("pixel shifts not fixed per pixel")
+	}
+	for _, sampler := range []Sampler{&StratifiedSampler{}, &SobolSampler{}} {
+		seq := progressive(sampler)
+		seen := make(map[int]bool)
+		for pass := 0; pass < 4; pass++ {
+			s := seq.sample(pass, pixelShift(7, 3, 4))
+			seen[int(s.Y*2)*2+int(s.X*2)] = true
+		}
+		if len(seen) != 4 {
+			t.Errorf("%T: 4 passes cover %d quadrants", sampler, len(seen))
+		}
+	}
+}
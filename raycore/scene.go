@@ -10,39 +10,56 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // SCENE
 type Scene struct {
-	ImgWidth     int
-	ImgHeight    int
-	TraceDepth   int
-	OverSampling int
-	VisionField  float64
-	CalcShadow   bool
-	StartLine    int `json:"-"`
-	EndLine      int `json:"-"`
-	GridWidth    int `json:"-"`
-	GridHeight   int `json:"-"`
-	CameraPos    *Vector
-	CameraLook   *Vector
-	CameraUp     *Vector
-	Look         *Vector     `json:"-"`
-	Vhor         *Vector     `json:"-"`
-	Vver         *Vector     `json:"-"`
-	Vp           *Vector     `json:"-"`
-	Image        *image.RGBA `json:"-"`
-	GroupList    []*Group
-	LightList    []Light
-	MaterialList []*Material
-	ImageList    map[string]image.Image `json:"-"`
+	ImgWidth      int
+	ImgHeight     int
+	TraceDepth    int
+	OverSampling  int
+	Sampler       Sampler
+	Filter        Filter
+	Adaptive      *AdaptiveSampling
+	GlossySamples int
+	VisionField   float64
+	CalcShadow    bool
+	TileSize      int
+	TileOrder     string
+	Crop          image.Rectangle
+	CropOnly      bool
+	CameraPos     *Vector
+	CameraLook    *Vector
+	CameraUp      *Vector
+	Aperture      float64
+	FocusDistance float64
+	Look          *Vector `json:"-"`
+	Vhor          *Vector `json:"-"`
+	Vver          *Vector `json:"-"`
+	Camera        Camera  `json:"-"`
+	CameraList    []*View
+	FrameDir      *Vector
+	FrameMargin   float64
+	Image         *image.RGBA  `json:"-"`
+	Frame         *Framebuffer `json:"-"`
+	SampleCount   *image.Gray  `json:"-"`
+	GroupList     []*Group
+	LightList     []*Light
+	Background    Background
+	MaterialList  []*Material
+	ImageList     map[string]image.Image `json:"-"`
+	Warnings      []string               `json:"-"` // problems that did not stop the scene loading
+	cacheLock     sync.Mutex
+	textureCache  map[string]*ImageTexture
+	ownView       *View
 }
 
 func NewScene() *Scene {
 	scn := &Scene{}
 
 	scn.GroupList = make([]*Group, 0)
-	scn.LightList = make([]Light, 0)
+	scn.LightList = make([]*Light, 0)
 	scn.MaterialList = make([]*Material, 0)
 	scn.ImageList = make(map[string]image.Image, 0)
 
@@ -52,43 +69,57 @@ func NewScene() *Scene {
 
 	scn.TraceDepth = 3   // bounces
 	scn.OverSampling = 1 // no OverSampling
+	scn.GlossySamples = 1
 	scn.VisionField = 60
 	scn.CalcShadow = true
 	return scn
 }
 
 func NewSceneFromFile(sceneFilename string) *Scene {
-	scn := &Scene{}
-
-	scn.GroupList = make([]*Group, 0)
-	scn.LightList = make([]Light, 0)
-	scn.MaterialList = make([]*Material, 0)
-	scn.ImageList = make(map[string]image.Image, 0)
-
-	// defaults
-	scn.ImgWidth = 320
-	scn.ImgHeight = 200
+	scn, err := LoadScene(sceneFilename)
+	if err != nil {
+		panic(err)
+	}
+	return scn
+}
 
-	scn.TraceDepth = 3   // bounces
-	scn.OverSampling = 1 // no OverSampling
-	scn.VisionField = 60
-	scn.CalcShadow = true
+// LoadScene reads a scene file, returning an error that gives the line of the scene file at
+// fault if it cannot be read.
+func LoadScene(sceneFilename string) (*Scene, error) {
+	scn := NewScene()
 
 	f, err := os.Open(sceneFilename)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer f.Close()
 
 	r := bufio.NewReaderSize(f, 4*1024)
 
-	scn.parseStream(r)
+	if err := scn.parseStream(r); err != nil {
+		return nil, fmt.Errorf("%s: %v", sceneFilename, err)
+	}
 
-	scn.Init()
+	if err := scn.Init(); err != nil {
+		return nil, fmt.Errorf("%s: %v", sceneFilename, err)
+	}
 
 	scn.CalcBounds()
 
-	return scn
+	return scn, nil
+}
+
+// ParseScene reads a scene from the text of a scene file.
+func ParseScene(text string) (*Scene, error) {
+	scn := NewScene()
+	if err := scn.parseStream(bufio.NewReader(strings.NewReader(text))); err != nil {
+		return nil, err
+	}
+	if err := scn.Init(); err != nil {
+		return nil, err
+	}
+	scn.CalcBounds()
+	return scn, nil
 }
 
 func NewSceneFromParams(imgWidth, imgHeight, traceDepth, overSampling int,
@@ -106,11 +137,13 @@ func NewSceneFromParams(imgWidth, imgHeight, traceDepth, overSampling int,
 	}
 
 	scn.GroupList = make([]*Group, 0)
-	scn.LightList = make([]Light, 0)
+	scn.LightList = make([]*Light, 0)
 	scn.MaterialList = make([]*Material, 0)
 	scn.ImageList = make(map[string]image.Image, 0)
 
-	scn.Init()
+	if err := scn.Init(); err != nil {
+		panic(err)
+	}
 
 	return scn
 }
@@ -118,7 +151,7 @@ func NewSceneFromParams(imgWidth, imgHeight, traceDepth, overSampling int,
 func NewSceneFromText(text string) *Scene {
 	scn := &Scene{}
 	scn.GroupList = make([]*Group, 0)
-	scn.LightList = make([]Light, 0)
+	scn.LightList = make([]*Light, 0)
 	scn.MaterialList = make([]*Material, 0)
 	scn.ImageList = make(map[string]image.Image, 0)
 	// defaults
@@ -128,28 +161,37 @@ func NewSceneFromText(text string) *Scene {
 
 	scn.TraceDepth = 3   // bounces
 	scn.OverSampling = 1 // no OverSampling
+	scn.GlossySamples = 1
 	scn.VisionField = 60
 	scn.CalcShadow = true
 
 	r := bufio.NewReader(strings.NewReader(text))
-	scn.parseStream(r)
-	scn.Init()
+	if err := scn.parseStream(r); err != nil {
+		panic(err)
+	}
+	if err := scn.Init(); err != nil {
+		panic(err)
+	}
 	scn.CalcBounds()
 	return scn
 }
 
 func (scn *Scene) AddGroup(group string) *Group {
 	r := bufio.NewReader(strings.NewReader(group))
-	scn.parseStream(r)
+	if err := scn.parseStream(r); err != nil {
+		panic(err)
+	}
 	return scn.GroupList[len(scn.GroupList)-1]
 }
 
-func (scn *Scene) parseStream(r *bufio.Reader) {
+// parseStream adds the contents of a scene file to the scene.
+func (scn *Scene) parseStream(r *bufio.Reader) error {
 	groupIndex := len(scn.GroupList) - 1
 	line, isPrefix, err := r.ReadLine()
+	lineNo := 1
+	var view *View // the camera block being read
 
 	newplane := func(data []string) *Plane {
-		fmt.Printf("%v\n", data)
 		mat, _ := strconv.Atoi(data[0])
 		pos := ParseVector(data[1:4])
 		nor := ParseVector(data[4:7])
@@ -163,13 +205,9 @@ func (scn *Scene) parseStream(r *bufio.Reader) {
 	for err == nil && !isPrefix {
 
 		s := string(line)
-		if len(s) == 0 {
-			line, isPrefix, err = r.ReadLine()
-			continue
-		}
-
-		if s[0:1] == "#" {
+		if len(s) == 0 || s[0:1] == "#" {
 			line, isPrefix, err = r.ReadLine()
+			lineNo++
 			continue
 		}
 
@@ -185,20 +223,61 @@ func (scn *Scene) parseStream(r *bufio.Reader) {
 			data = append(data, strings.Trim(item, " "))
 		}
 
+		if view != nil {
+			handled, perr := view.parse(word, data)
+			if perr != nil {
+				return fmt.Errorf("line %d: %v", lineNo, perr)
+			}
+			if handled {
+				line, isPrefix, err = r.ReadLine()
+				lineNo++
+				continue
+			}
+		}
+
 		switch word {
 		case "size":
 			scn.ImgWidth, _ = strconv.Atoi(data[0])
 			scn.ImgHeight, _ = strconv.Atoi(data[1])
-			scn.EndLine = scn.ImgHeight - 1 // End rendering line
 		case "nbounces":
 			scn.TraceDepth, _ = strconv.Atoi(data[0]) // n. bounces
 		case "oversampling":
 			scn.OverSampling, _ = strconv.Atoi(data[0])
+		case "sampler":
+			sampler, err := ParseSampler(data[0])
+			if err != nil {
+				return fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			scn.Sampler = sampler
+		case "tiles":
+			size, order, err := parseTiles(data)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			scn.TileSize, scn.TileOrder = size, order
+		case "adaptive":
+			scn.Adaptive = ParseAdaptive(data)
+		case "filter":
+			filter, err := ParseFilter(data)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			scn.Filter = filter
+		case "glossysamples":
+			scn.GlossySamples, _ = strconv.Atoi(data[0])
 		case "vision":
 			scn.VisionField, _ = strconv.ParseFloat(data[0], 64)
 		case "renderslice":
-			scn.StartLine, _ = strconv.Atoi(data[0])
-			scn.EndLine, _ = strconv.Atoi(data[1])
+			// the lines start to end, both included, across the whole width
+			start, _ := strconv.Atoi(data[0])
+			end, _ := strconv.Atoi(data[1])
+			scn.Crop = image.Rect(0, start, math.MaxInt32, end+1)
+		case "crop":
+			crop, only, err := ParseCrop(data)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			scn.Crop, scn.CropOnly = crop, only
 
 		case "cameraPos":
 			scn.CameraPos = ParseVector(data)
@@ -206,6 +285,18 @@ func (scn *Scene) parseStream(r *bufio.Reader) {
 			scn.CameraLook = ParseVector(data)
 		case "cameraUp":
 			scn.CameraUp = ParseVector(data)
+		case "projection":
+			camera, err := ParseProjection(data)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			scn.Camera = camera
+		case "autoframe":
+			scn.FrameDir, scn.FrameMargin = parseAutoFrame(data)
+		case "aperture":
+			scn.Aperture, _ = strconv.ParseFloat(data[0], 64)
+		case "focusDistance":
+			scn.FocusDistance, _ = strconv.ParseFloat(data[0], 64)
 
 		case "shadow":
 			if data[0] == "true" {
@@ -214,7 +305,14 @@ func (scn *Scene) parseStream(r *bufio.Reader) {
 				scn.CalcShadow = false
 			}
 
+		case "camera":
+			// the camera keywords that follow, up to the next camera or group, set up a
+			// named view
+			view = &View{Name: data[0]}
+			scn.CameraList = append(scn.CameraList, view)
+
 		case "group":
+			view = nil
 			var plane GroupBounds
 			plane = nil
 			if len(data) == 16 {
@@ -249,8 +347,14 @@ func (scn *Scene) parseStream(r *bufio.Reader) {
 			wid, _ := strconv.ParseFloat(data[9], 64)
 			hei, _ := strconv.ParseFloat(data[10], 64)
 			fn := data[11]
-			scn.GroupList[groupIndex].ObjectList = append(scn.GroupList[groupIndex].ObjectList,
-				NewTexture(pos.X, pos.Y, pos.Z, nor.X, nor.Y, nor.Z, up.X, up.Y, up.Z, wid, hei, fn, scn))
+			tex, err := NewTexture(pos.X, pos.Y, pos.Z, nor.X, nor.Y, nor.Z, up.X, up.Y, up.Z, wid, hei, fn, scn)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			if err := tex.Map.SetOptions(data[12:]); err != nil {
+				return fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			scn.GroupList[groupIndex].ObjectList = append(scn.GroupList[groupIndex].ObjectList, tex)
 
 		case "cube":
 			mat, _ := strconv.Atoi(data[0])
@@ -270,36 +374,152 @@ func (scn *Scene) parseStream(r *bufio.Reader) {
 			scn.GroupList[groupIndex].ObjectList = append(scn.GroupList[groupIndex].ObjectList,
 				NewCylinder(pos.X, pos.Y, pos.Z, dir.X, dir.Y, dir.Z, len, rad, mat, scn))
 
+		case "background":
+			background, err := ParseBackground(data)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			scn.Background = background
+
 		case "light":
-			light := Light{ParseVector(data[0:3]), ParseColor(data[3:6]), data[6]}
+			light, err := ParseLight(data)
+			if err != nil {
+				return fmt.Errorf("line %d: %v", lineNo, err)
+			}
 			scn.LightList = append(scn.LightList, light)
 
 		case "material":
 			mat := ParseMaterial(data)
+			if name, options := materialImage(data); name != "" {
+				tex, err := scn.LoadTexture(name)
+				switch {
+				case os.IsNotExist(err):
+					// a missing image leaves the material its flat color
+					scn.Warnings = append(scn.Warnings, fmt.Sprintf("line %d: %v, using the flat color", lineNo, err))
+				case err != nil:
+					return fmt.Errorf("line %d: %v", lineNo, err)
+				default:
+					if err := tex.SetOptions(options); err != nil {
+						return fmt.Errorf("line %d: %v", lineNo, err)
+					}
+					mat.DiffuseMap = tex
+				}
+			}
 			scn.MaterialList = append(scn.MaterialList, mat)
 
+		case "pattern":
+			// a procedural texture for a channel of the last material defined:
+			// channel kind uv|object|world scale r1 g1 b1 r2 g2 b2 [param], where object
+			// space is relative to the center of the group, not of the primitive
+			mat := scn.MaterialList[len(scn.MaterialList)-1]
+			if !mat.SetMap(data[0], ParseProcedural(data[1:])) {
+				return fmt.Errorf("line %d: unknown material channel %s", lineNo, data[0])
+			}
+
+		case "bump":
+			// a height map for the last material defined, either an image or procedural
+			// noise: strength image [options] or strength kind space scale [param]
+			mat := scn.MaterialList[len(scn.MaterialList)-1]
+			mat.BumpStrength, _ = strconv.ParseFloat(data[0], 64)
+			if isProceduralKind(data[1]) {
+				scale, _ := strconv.ParseFloat(data[3], 64)
+				param := 0.0
+				if len(data) > 4 {
+					param, _ = strconv.ParseFloat(data[4], 64)
+				}
+				mat.BumpMap = NewProcedural(data[1], data[2], scale, Color{}, Color{1.0, 1.0, 1.0}, param)
+				break
+			}
+			tex, err := scn.LoadTexture(data[1])
+			if err != nil {
+				return fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			if err := tex.SetOptions(data[2:]); err != nil {
+				return fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			mat.BumpMap = tex
+
+		case "normalmap":
+			// a tangent-space normal map for the last material defined: image [options]
+			mat := scn.MaterialList[len(scn.MaterialList)-1]
+			tex, err := scn.LoadTexture(data[0])
+			if err != nil {
+				return fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			if err := tex.SetOptions(data[1:]); err != nil {
+				return fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			mat.NormalMap = tex
+
+		case "emission":
+			// emission applies to the last material defined
+			mat := scn.MaterialList[len(scn.MaterialList)-1]
+			mat.Emission = ParseColor(data[0:3])
+			mat.EmissionStrength = 1.0
+			if len(data) > 3 {
+				mat.EmissionStrength, _ = strconv.ParseFloat(data[3], 64)
+			}
+
 		}
 		line, isPrefix, err = r.ReadLine()
+		lineNo++
 	}
 
 	if isPrefix {
-		panic(errors.New("buffer size to small"))
+		return fmt.Errorf("line %d: buffer size to small", lineNo)
 	}
 	if err != io.EOF {
-		panic(err)
+		return err
 	}
+	return nil
 }
 
-func (scn *Scene) Init() {
-
-	scn.StartLine = 0 // Start rendering line
-	scn.EndLine = scn.ImgHeight - 1
+// Init sets up a scene that has been read for rendering. A scene without a camera of its own
+// starts with the first of its named cameras.
+func (scn *Scene) Init() error {
 
 	scn.Image = image.NewRGBA(image.Rect(0, 0, scn.ImgWidth, scn.ImgHeight))
 
-	scn.GridWidth = scn.ImgWidth * scn.OverSampling
-	scn.GridHeight = scn.ImgHeight * scn.OverSampling
+	if scn.OverSampling < 1 {
+		scn.OverSampling = 1
+	}
+	if scn.Sampler == nil {
+		scn.Sampler = &StratifiedSampler{}
+	}
+	if scn.Filter == nil {
+		scn.Filter = &BoxFilter{R: 0.5}
+	}
+
+	if scn.FrameDir != nil {
+		// a scene with nothing to frame keeps its camera
+		scn.AutoFrame(scn.FrameDir, scn.FrameMargin)
+	}
+	if (scn.CameraPos == nil || scn.CameraLook == nil) && len(scn.CameraList) > 0 {
+		if err := scn.UseCamera(scn.CameraList[0].Name); err != nil {
+			return err
+		}
+	}
+	if err := scn.initCamera(); err != nil {
+		return err
+	}
+
+	if scn.Background != nil {
+		scn.Background.Init(scn)
+	}
+
+	scn.initGeometryLights()
+	return nil
+}
 
+// initCamera sets up the camera basis and the projection for the camera fields of the scene.
+// Without a cameraUp the z axis is up.
+func (scn *Scene) initCamera() error {
+	if scn.CameraPos == nil || scn.CameraLook == nil {
+		return errors.New("no camera, the scene needs a cameraPos and cameraLook")
+	}
+	if scn.CameraUp == nil {
+		scn.CameraUp = &Vector{0, 0, 1}
+	}
 	scn.Look = scn.CameraLook.Sub(scn.CameraPos)
 	scn.Vhor = scn.Look.Cross(scn.CameraUp)
 	scn.Vhor = scn.Vhor.Normalize()
@@ -307,16 +527,45 @@ func (scn *Scene) Init() {
 	scn.Vver = scn.Look.Cross(scn.Vhor)
 	scn.Vver = scn.Vver.Normalize()
 
-	fl := float64(scn.GridWidth) / (2 * math.Tan((0.5*scn.VisionField)*PI_180))
-
-	Vp := scn.Look.Normalize()
-
-	Vp.X = Vp.X*fl - 0.5*(float64(scn.GridWidth)*scn.Vhor.X+float64(scn.GridHeight)*scn.Vver.X)
-	Vp.Y = Vp.Y*fl - 0.5*(float64(scn.GridWidth)*scn.Vhor.Y+float64(scn.GridHeight)*scn.Vver.Y)
-	Vp.Z = Vp.Z*fl - 0.5*(float64(scn.GridWidth)*scn.Vhor.Z+float64(scn.GridHeight)*scn.Vver.Z)
-
-	scn.Vp = Vp
+	if scn.Camera == nil {
+		scn.Camera = &PerspectiveCamera{}
+	}
+	scn.Camera.Init(scn)
+	return nil
+}
 
+// initGeometryLights adds a light for every emissive primitive that can be sampled as a light,
+// and a warning for those that cannot, which glow but light nothing.
+func (scn *Scene) initGeometryLights() {
+	lights := make([]*Light, 0, len(scn.LightList))
+	for _, light := range scn.LightList {
+		if light.Kind != "geometry" {
+			lights = append(lights, light)
+		}
+	}
+	for g, grp := range scn.GroupList {
+		for i, obj := range grp.ObjectList {
+			mat := obj.GetMaterial()
+			if mat == nil || mat.Emitted() == (Color{}) {
+				continue
+			}
+			emitter, ok := obj.(Emitter)
+			if plane, isPlane := obj.(*Plane); isPlane && plane.infinite() {
+				ok = false
+			}
+			if !ok {
+				scn.Warnings = append(scn.Warnings, fmt.Sprintf("emissive %s %d in group %s cannot light the scene",
+					obj.GetType(), i, grp.Name))
+				continue
+			}
+			light := NewGeometryLight(emitter, mat.Emitted(), g, i)
+			if mat.EmissionMap != nil {
+				light.material, light.center = mat, grp.Center
+			}
+			lights = append(lights, light)
+		}
+	}
+	scn.LightList = lights
 }
 
 func (scn *Scene) CalcBounds() {
@@ -325,6 +574,34 @@ func (scn *Scene) CalcBounds() {
 	}
 }
 
+// BoundingSphere returns a sphere around the bounding spheres of all the groups, and false if
+// the scene has nothing but infinite planes.
+func (scn *Scene) BoundingSphere() (*Vector, float64, bool) {
+	var center *Vector
+	var radius float64
+	for _, grp := range scn.GroupList {
+		c, r, ok := grp.BoundingSphere()
+		if !ok {
+			continue
+		}
+		if center == nil {
+			center, radius = c, r
+			continue
+		}
+		d := c.Sub(center).Module()
+		switch {
+		case d+r <= radius:
+		case d+radius <= r:
+			center, radius = c, r
+		default:
+			merged := 0.5 * (d + radius + r)
+			center = center.Add(c.Sub(center).Mul((merged - radius) / d))
+			radius = merged
+		}
+	}
+	return center, radius, center != nil
+}
+
 func (scn *Scene) ObjectCount() int {
 	count := 0
 	for _, grp := range scn.GroupList {
@@ -353,6 +630,9 @@ func ParseColor(line []string) Color {
 }
 
 func ParseMaterial(line []string) *Material {
+	if line[0] == "pbr" {
+		return ParsePBRMaterial(line[1:])
+	}
 	var f [6]float64
 	for i, item := range line[3:8] {
 		f[i], _ = strconv.ParseFloat(item, 64)
@@ -360,3 +640,30 @@ func ParseMaterial(line []string) *Material {
 	m, _ := NewMaterial(ParseColor(line[0:3]), f[0], f[1], f[2], f[3], f[4], f[5])
 	return m
 }
+
+// ParsePBRMaterial parses the values following "material pbr":
+// r g b metallic roughness [transmission ior]
+func ParsePBRMaterial(line []string) *Material {
+	var f [4]float64
+	for i, item := range line[3:] {
+		if i < len(f) {
+			f[i], _ = strconv.ParseFloat(item, 64)
+		}
+	}
+	m, _ := NewPBRMaterial(ParseColor(line[0:3]), f[0], f[1], f[2], f[3])
+	return m
+}
+
+// materialImage returns the name of the texture image that may follow the values of a
+// material line, along with the texture options after it.
+func materialImage(line []string) (string, []string) {
+	for i, item := range line {
+		if i == 0 && item == "pbr" {
+			continue
+		}
+		if _, err := strconv.ParseFloat(item, 64); err != nil {
+			return item, line[i+1:]
+		}
+	}
+	return "", nil
+}
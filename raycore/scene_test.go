@@ -0,0 +1,102 @@
+package raycore
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testCamera = "cameraPos 0 -10 0\ncameraLook 0 0 0\ncameraUp 0 0 1\n"
+
+func TestMissingMaterialImage(t *testing.T) {
+	scn, err := ParseScene(testCamera + "material 0.0 1.0 0.0 1.6 0.0 0.0 0.0 0.0 0.0 no/such/image.png\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scn.Warnings) != 1 || !strings.HasPrefix(scn.Warnings[0], "line 4: ") {
+		t.Errorf("warnings %q, want one for line 4", scn.Warnings)
+	}
+	if mat := scn.MaterialList[0]; mat.DiffuseMap != nil || mat.Color != (Color{0, 1, 0}) {
+		t.Errorf("material has map %v and color %v, want the flat color", mat.DiffuseMap, mat.Color)
+	}
+}
+
+func TestParseSceneErrorLines(t *testing.T) {
+	tests := []struct {
+		text string
+		line int
+	}{
+		{"sampler random\n", 1},
+		{"size 64 48\n\nfilter sinc\n", 3},
+		{"size 64 48\nlight 0 0 10 1 1 1 point cubic\n", 2},
+		{"# tiles\ntiles 16 zigzag\n", 2},
+		{"crop 10 10 x 20\n", 1},
+		{"projection stereographic\n", 1},
+		{"material 1 1 1 1 0 0 0 0 0\nbump 0.1 no/such/bump.png\n", 2},
+		{"material 1 1 1 1 0 0 0 0 0\npattern shine checker uv 4 0 0 0 1 1 1\n", 2},
+	}
+	for _, tt := range tests {
+		_, err := ParseScene(testCamera + tt.text)
+		want := fmt.Sprintf("line %d: ", tt.line+3) // after the camera lines
+		if err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("ParseScene(%q) error %v, want one starting %q", tt.text, err, want)
+		}
+	}
+}
+
+func TestLoadImageWithoutImageList(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "dot.png")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	png.Encode(f, image.NewRGBA(image.Rect(0, 0, 1, 1)))
+	f.Close()
+
+	scn := &Scene{}
+	if _, err := scn.LoadImage(filename); err != nil {
+		t.Fatal(err)
+	}
+	if scn.ImageList[filename] == nil {
+		t.Error("image not added to the image list")
+	}
+}
+
+func TestImageCacheKey(t *testing.T) {
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "dot.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	png.Encode(f, image.NewRGBA(image.Rect(0, 0, 1, 1)))
+	f.Close()
+
+	// an entry of the image list is found by its own name, clean or not
+	named := image.NewGray(image.Rect(0, 0, 2, 2))
+	scn := &Scene{ImageList: map[string]image.Image{"./named.png": named}}
+	if img, err := scn.LoadImage("./named.png"); err != nil || img != named {
+		t.Errorf("LoadImage of a listed name = %v, %v", img, err)
+	}
+
+	// two ways of writing one path decode the file once
+	first, err := scn.LoadImage(dir + "/./dot.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := scn.LoadImage(dir + "//dot.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second || len(scn.ImageList) != 2 {
+		t.Errorf("%d images listed, want the named one and dot.png once", len(scn.ImageList))
+	}
+	scn.LoadTexture(dir + "/./dot.png")
+	scn.LoadTexture(dir + "//dot.png")
+	if len(scn.textureCache) != 1 {
+		t.Errorf("%d textures cached, want one", len(scn.textureCache))
+	}
+}
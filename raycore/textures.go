@@ -0,0 +1,293 @@
+package raycore
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+)
+
+// Hit describes a point on the surface of a primitive, as used to look up textures.
+// Local is the Point relative to the center of the primitive's group. Footprint is the size
+// of the pixel being rendered in u,v units, zero if it is not known.
+type Hit struct {
+	Point     *Vector
+	Local     *Vector
+	U, V      float64
+	Footprint float64
+}
+
+// TextureMap is a color that varies over the surface of a primitive.
+type TextureMap interface {
+	GetColor(h *Hit) Color
+}
+
+// ImageTexture maps an image onto the u,v coordinates of a surface.
+// Filter is nearest, the default, bilinear or trilinear, where trilinear blends between the
+// two mipmaps closest to the footprint of the pixel. Wrap selects what happens outside [0,1] and is
+// repeat, clamp or mirror.
+// The alpha of the image makes the surface see-through. If AlphaCutoff is set alpha is
+// tested instead, so the surface is either fully opaque or fully transparent.
+type ImageTexture struct {
+	ImageName   string
+	Filter      string
+	Wrap        string
+	AlphaCutoff float64
+	levels      []*mipLevel
+}
+
+// mipLevel is one level of the mipmap, with colors premultiplied by alpha.
+type mipLevel struct {
+	width  int
+	height int
+	pix    []Color
+	alpha  []float64
+}
+
+// NewImageTexture creates a nearest sampled, repeating texture from a decoded image and
+// generates its mipmaps.
+func NewImageTexture(name string, img image.Image) *ImageTexture {
+	bounds := img.Bounds()
+	level := &mipLevel{
+		width:  bounds.Dx(),
+		height: bounds.Dy(),
+		pix:    make([]Color, bounds.Dx()*bounds.Dy()),
+		alpha:  make([]float64, bounds.Dx()*bounds.Dy()),
+	}
+	for y := 0; y < level.height; y++ {
+		for x := 0; x < level.width; x++ {
+			i := y*level.width + x
+			if hdr, ok := img.(*HDRImage); ok {
+				level.pix[i] = hdr.ColorAt(x, y)
+				level.alpha[i] = 1.0
+				continue
+			}
+			r, g, b, a := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			level.pix[i] = Color{float64(r) / 0xffff, float64(g) / 0xffff, float64(b) / 0xffff}
+			level.alpha[i] = float64(a) / 0xffff
+		}
+	}
+
+	t := &ImageTexture{
+		ImageName: name,
+		Filter:    "nearest",
+		Wrap:      "repeat",
+		levels:    []*mipLevel{level},
+	}
+	for level.width > 1 || level.height > 1 {
+		level = level.downsample()
+		t.levels = append(t.levels, level)
+	}
+	return t
+}
+
+// SetOptions sets the filter and wrap mode by name, and the alpha cutoff from "cutoff value".
+func (t *ImageTexture) SetOptions(options []string) error {
+	for i := 0; i < len(options); i++ {
+		switch option := options[i]; option {
+		case "nearest", "bilinear", "trilinear":
+			t.Filter = option
+		case "repeat", "clamp", "mirror":
+			t.Wrap = option
+		case "cutoff":
+			if i+1 == len(options) {
+				return errors.New("texture cutoff needs a value")
+			}
+			i++
+			t.AlphaCutoff, _ = strconv.ParseFloat(options[i], 64)
+		default:
+			return fmt.Errorf("unknown texture option %s", option)
+		}
+	}
+	return nil
+}
+
+func (t *ImageTexture) GetColor(h *Hit) Color {
+	c, _ := t.Sample(h.U, h.V, h.Footprint)
+	return c
+}
+
+// Sample returns the color and alpha of the texture at u,v for a pixel footprint of the
+// given size in u,v units.
+func (t *ImageTexture) Sample(u, v, footprint float64) (Color, float64) {
+	var c Color
+	var a float64
+	switch t.Filter {
+	case "nearest":
+		c, a = t.levels[0].nearest(u, v, t.Wrap)
+	case "trilinear":
+		lod := 0.0
+		if footprint > 0.0 {
+			base := t.levels[0]
+			lod = math.Log2(footprint * float64(maxInt(base.width, base.height)))
+		}
+		lod = math.Max(0.0, math.Min(lod, float64(len(t.levels)-1)))
+		l0 := int(lod)
+		l1 := minInt(l0+1, len(t.levels)-1)
+		f := lod - float64(l0)
+		c0, a0 := t.levels[l0].bilinear(u, v, t.Wrap)
+		c1, a1 := t.levels[l1].bilinear(u, v, t.Wrap)
+		c, a = c0.Mul(1.0-f).Add(c1.Mul(f)), a0*(1.0-f)+a1*f
+	default:
+		c, a = t.levels[0].bilinear(u, v, t.Wrap)
+	}
+	if a > 0.0 {
+		c = c.Mul(1.0 / a)
+	}
+	if t.AlphaCutoff > 0.0 {
+		if a < t.AlphaCutoff {
+			a = 0.0
+		} else {
+			a = 1.0
+		}
+	}
+	return c, a
+}
+
+func (m *mipLevel) texel(x, y int, wrap string) (Color, float64) {
+	x = wrapIndex(x, m.width, wrap)
+	y = wrapIndex(y, m.height, wrap)
+	return m.pix[y*m.width+x], m.alpha[y*m.width+x]
+}
+
+func (m *mipLevel) nearest(u, v float64, wrap string) (Color, float64) {
+	return m.texel(int(math.Floor(u*float64(m.width))), int(math.Floor(v*float64(m.height))), wrap)
+}
+
+func (m *mipLevel) bilinear(u, v float64, wrap string) (Color, float64) {
+	x := u*float64(m.width) - 0.5
+	y := v*float64(m.height) - 0.5
+	x0, y0 := math.Floor(x), math.Floor(y)
+	fx, fy := x-x0, y-y0
+	c00, a00 := m.texel(int(x0), int(y0), wrap)
+	c10, a10 := m.texel(int(x0)+1, int(y0), wrap)
+	c01, a01 := m.texel(int(x0), int(y0)+1, wrap)
+	c11, a11 := m.texel(int(x0)+1, int(y0)+1, wrap)
+	top := c00.Mul(1.0 - fx).Add(c10.Mul(fx))
+	bottom := c01.Mul(1.0 - fx).Add(c11.Mul(fx))
+	a := (a00*(1.0-fx)+a10*fx)*(1.0-fy) + (a01*(1.0-fx)+a11*fx)*fy
+	return top.Mul(1.0 - fy).Add(bottom.Mul(fy)), a
+}
+
+// downsample halves the level by averaging blocks of 2x2 texels.
+func (m *mipLevel) downsample() *mipLevel {
+	next := &mipLevel{
+		width:  maxInt(1, m.width/2),
+		height: maxInt(1, m.height/2),
+	}
+	next.pix = make([]Color, next.width*next.height)
+	next.alpha = make([]float64, next.width*next.height)
+	for y := 0; y < next.height; y++ {
+		for x := 0; x < next.width; x++ {
+			var c Color
+			var a float64
+			for _, d := range [][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				tc, ta := m.texel(2*x+d[0], 2*y+d[1], "clamp")
+				c = c.Add(tc)
+				a += ta
+			}
+			next.pix[y*next.width+x] = c.Mul(0.25)
+			next.alpha[y*next.width+x] = a * 0.25
+		}
+	}
+	return next
+}
+
+// wrapIndex brings a texel index inside [0,n) according to the wrap mode.
+func wrapIndex(i, n int, wrap string) int {
+	switch wrap {
+	case "clamp":
+		return clampInt(i, 0, n-1)
+	case "mirror":
+		i = ((i % (2 * n)) + 2*n) % (2 * n)
+		if i >= n {
+			i = 2*n - 1 - i
+		}
+		return i
+	}
+	return ((i % n) + n) % n
+}
+
+// uvFootprint converts a footprint of size scene units at point on the surface of obj into
+// u,v units, by measuring how u,v change when stepping along the surface. Steps are taken
+// both ways and the smaller change is used, as one of them may cross the seam of a primitive.
+func uvFootprint(obj Object, point, normal *Vector, size, u, v float64) float64 {
+	if size <= 0.0 {
+		return 0.0
+	}
+	t, b := orthonormalBasis(normal)
+	footprint := 0.0
+	for _, step := range []*Vector{t, b} {
+		fu, fv := obj.GetUV(point.Add(step.Mul(size)))
+		bu, bv := obj.GetUV(point.Sub(step.Mul(size)))
+		du := math.Min(math.Abs(fu-u), math.Abs(bu-u))
+		dv := math.Min(math.Abs(fv-v), math.Abs(bv-v))
+		footprint = math.Max(footprint, math.Max(du, dv))
+	}
+	return footprint
+}
+
+// surfaceAlpha returns how opaque obj is at point, from the alpha of its image, for a pixel
+// footprint of size scene units.
+func surfaceAlpha(obj Object, point *Vector, size float64) float64 {
+	var tex *ImageTexture
+	if t, ok := obj.(*Texture); ok {
+		tex = t.Map
+	} else if m := obj.GetMaterial(); m != nil {
+		tex, _ = m.DiffuseMap.(*ImageTexture)
+	}
+	if tex == nil {
+		return 1.0
+	}
+	u, v := obj.GetUV(point)
+	_, a := tex.Sample(u, v, uvFootprint(obj, point, obj.GetNormal(point), size, u, v))
+	return a
+}
+
+// perturbNormal returns the normal of obj at h tilted by the normal map and bump map of m.
+// The slope of the bump map is measured over a step of size scene units, the footprint of
+// the pixel, so that it is smoothed like a filtered texture.
+func perturbNormal(obj Object, m *Material, h *Hit, normal *Vector, size float64) *Vector {
+	t, b := obj.GetTangent(h.Point)
+	t = t.Sub(normal.Mul(normal.Dot(t))).Normalize()
+	b = b.Sub(normal.Mul(normal.Dot(b))).Sub(t.Mul(t.Dot(b))).Normalize()
+
+	n := normal
+	if m.NormalMap != nil {
+		c := m.NormalMap.GetColor(h)
+		// up the image is towards decreasing v
+		n = t.Mul(2.0*c.R - 1.0).Sub(b.Mul(2.0*c.G - 1.0)).Add(normal.Mul(2.0*c.B - 1.0)).Normalize()
+	}
+	if m.BumpMap != nil && m.BumpStrength != 0.0 {
+		step := math.Max(size, 1e-4)
+		height := m.BumpMap.GetColor(h).Luminance()
+		var slope [2]float64
+		for i, dir := range []*Vector{t, b} {
+			delta := dir.Mul(step)
+			moved := &Hit{
+				Point:     h.Point.Add(delta),
+				Local:     h.Local.Add(delta),
+				Footprint: h.Footprint,
+			}
+			moved.U, moved.V = obj.GetUV(moved.Point)
+			slope[i] = m.BumpStrength * (m.BumpMap.GetColor(moved).Luminance() - height) / step
+		}
+		n = n.Sub(t.Mul(slope[0])).Sub(b.Mul(slope[1])).Normalize()
+	}
+	return n
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,43 @@
+package raycore
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestTextureCutout(t *testing.T) {
+	// opaque on the left half, transparent on the right
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 1))
+	for x := 0; x < 4; x++ {
+		a := uint8(255)
+		if x >= 2 {
+			a = 0
+		}
+		img.SetNRGBA(x, 0, color.NRGBA{255, 0, 0, a})
+	}
+	tex := &Texture{Map: NewImageTexture("half.png", img)}
+	if tex.Map.Filter != "nearest" {
+		t.Fatalf("default filter %s, want nearest", tex.Map.Filter)
+	}
+
+	tests := []struct {
+		filter string
+		u      float64
+		want   bool
+	}{
+		{"nearest", 0.45, true},
+		{"nearest", 0.49, true},
+		{"nearest", 0.55, false},
+		// bilinear alpha falls from 1 at the center of pixel 1 to 0 at the center of pixel 2
+		{"bilinear", 0.45, true},
+		{"bilinear", 0.55, false},
+		{"bilinear", 0.6, false},
+	}
+	for _, tt := range tests {
+		tex.Map.Filter = tt.filter
+		if _, got := tex.getColor(tt.u, 0.5, 0.0); got != tt.want {
+			t.Errorf("%s at u %v: texture there %v, want %v", tt.filter, tt.u, got, tt.want)
+		}
+	}
+}
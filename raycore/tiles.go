@@ -0,0 +1,151 @@
+package raycore
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Region returns the part of the image that is rendered: the crop window clipped to the
+// image, or the whole image if there is no crop window.
+func (scn *Scene) Region() image.Rectangle {
+	full := image.Rect(0, 0, scn.ImgWidth, scn.ImgHeight)
+	if scn.Crop.Empty() {
+		return full
+	}
+	return scn.Crop.Intersect(full)
+}
+
+// sampled returns the part of the image that is sampled: the Region with a border as wide as
+// the filter reaches, clipped to the image, so that the pixels at the edge of a crop window
+// also get the samples of their neighbours outside it.
+func (scn *Scene) sampled() image.Rectangle {
+	border := 0
+	if scn.Filter != nil {
+		border = maxInt(0, int(math.Ceil(scn.Filter.Radius()-0.5)))
+	}
+	return scn.Region().Inset(-border).Intersect(image.Rect(0, 0, scn.ImgWidth, scn.ImgHeight))
+}
+
+// Output returns the rendered image, or only its crop window if CropOnly is set.
+func (scn *Scene) Output() image.Image {
+	if scn.CropOnly {
+		return scn.Image.SubImage(scn.Region())
+	}
+	return scn.Image
+}
+
+// ParseCrop parses a crop window: x0 y0 x1 y1 [only], with x1,y1 just outside the window.
+// With only, the output is the window alone rather than the full image.
+func ParseCrop(line []string) (image.Rectangle, bool, error) {
+	if len(line) < 4 {
+		return image.Rectangle{}, false, fmt.Errorf("crop needs x0 y0 x1 y1")
+	}
+	var c [4]int
+	for i := range c {
+		var err error
+		if c[i], err = strconv.Atoi(line[i]); err != nil {
+			return image.Rectangle{}, false, fmt.Errorf("bad crop value %s", line[i])
+		}
+	}
+	if c[2] <= c[0] || c[3] <= c[1] {
+		return image.Rectangle{}, false, fmt.Errorf("empty crop window %d,%d %d,%d", c[0], c[1], c[2], c[3])
+	}
+	return image.Rect(c[0], c[1], c[2], c[3]), len(line) > 4 && line[4] == "only", nil
+}
+
+// Tiles splits the part of the image being sampled, the Region and the border around it the
+// filter reaches, into the pieces of work handed to the workers, in the order they are
+// rendered. With a TileSize of zero the pieces are whole lines, else they are square tiles in
+// TileOrder: row, spiral from the center outwards, or along a Hilbert curve.
+func (scn *Scene) Tiles() []image.Rectangle {
+	return scn.tiles(scn.sampled(), scn.TileSize)
+}
+
+func (scn *Scene) tiles(area image.Rectangle, size int) []image.Rectangle {
+	var tiles []image.Rectangle
+	if size <= 0 {
+		for y := area.Min.Y; y < area.Max.Y; y++ {
+			tiles = append(tiles, image.Rect(area.Min.X, y, area.Max.X, y+1))
+		}
+		return tiles
+	}
+
+	for y := area.Min.Y; y < area.Max.Y; y += size {
+		for x := area.Min.X; x < area.Max.X; x += size {
+			tiles = append(tiles, image.Rect(x, y, x+size, y+size).Intersect(area))
+		}
+	}
+
+	switch scn.TileOrder {
+	case "spiral":
+		// by ring around the center tile, then by angle within the ring
+		cx := float64(area.Min.X+area.Max.X) / 2.0
+		cy := float64(area.Min.Y+area.Max.Y) / 2.0
+		key := func(t image.Rectangle) (int, float64) {
+			dx := (float64(t.Min.X+t.Max.X)/2.0 - cx) / float64(size)
+			dy := (float64(t.Min.Y+t.Max.Y)/2.0 - cy) / float64(size)
+			ring := int(math.Max(math.Abs(math.Round(dx)), math.Abs(math.Round(dy))))
+			return ring, math.Atan2(dy, dx)
+		}
+		sort.SliceStable(tiles, func(i, j int) bool {
+			ri, ai := key(tiles[i])
+			rj, aj := key(tiles[j])
+			if ri != rj {
+				return ri < rj
+			}
+			return ai < aj
+		})
+	case "hilbert":
+		n := 1
+		for n*size < area.Dx() || n*size < area.Dy() {
+			n *= 2
+		}
+		sort.SliceStable(tiles, func(i, j int) bool {
+			return hilbertIndex(n, (tiles[i].Min.X-area.Min.X)/size, (tiles[i].Min.Y-area.Min.Y)/size) <
+				hilbertIndex(n, (tiles[j].Min.X-area.Min.X)/size, (tiles[j].Min.Y-area.Min.Y)/size)
+		})
+	}
+	return tiles
+}
+
+// hilbertIndex returns the distance along a Hilbert curve filling an n×n grid, n a power of
+// two, of the cell x,y.
+func hilbertIndex(n, x, y int) int {
+	d := 0
+	for s := n / 2; s > 0; s /= 2 {
+		rx, ry := 0, 0
+		if x&s > 0 {
+			rx = 1
+		}
+		if y&s > 0 {
+			ry = 1
+		}
+		d += s * s * ((3 * rx) ^ ry)
+		// rotate the quadrant
+		if ry == 0 {
+			if rx == 1 {
+				x = s - 1 - x
+				y = s - 1 - y
+			}
+			x, y = y, x
+		}
+	}
+	return d
+}
+
+// parseTiles parses the values following tiles on a scene file line: size [row|spiral|hilbert]
+func parseTiles(line []string) (int, string, error) {
+	size, _ := strconv.Atoi(line[0])
+	order := "row"
+	if len(line) > 1 {
+		order = line[1]
+	}
+	switch order {
+	case "row", "spiral", "hilbert":
+		return size, order, nil
+	}
+	return 0, "", fmt.Errorf("unknown tile order %s", order)
+}
@@ -0,0 +1,155 @@
+package raycore
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func TestParseCrop(t *testing.T) {
+	tests := []struct {
+		line string
+		want image.Rectangle
+		only bool
+		ok   bool
+	}{
+		{"10 20 30 40", image.Rect(10, 20, 30, 40), false, true},
+		{"10 20 30 40 only", image.Rect(10, 20, 30, 40), true, true},
+		{"0 0 1 1 full", image.Rect(0, 0, 1, 1), false, true},
+		{"10 20 30", image.Rectangle{}, false, false},
+		{"10 20 x 40", image.Rectangle{}, false, false},
+		{"10 20 10 40", image.Rectangle{}, false, false},
+		{"30 20 10 40", image.Rectangle{}, false, false},
+		{"10 40 30 20", image.Rectangle{}, false, false},
+	}
+	for _, tt := range tests {
+		crop, only, err := ParseCrop(strings.Fields(tt.line))
+		if (err == nil) != tt.ok || crop != tt.want || only != tt.only {
+			t.Errorf("ParseCrop(%q) = %v, %v, %v, want %v, %v, ok %v", tt.line, crop, only, err, tt.want, tt.only, tt.ok)
+		}
+	}
+}
+
+func TestSampledBorder(t *testing.T) {
+	tests := []struct {
+		filter Filter
+		crop   image.Rectangle
+		want   image.Rectangle
+	}{
+		{&BoxFilter{R: 0.5}, image.Rect(10, 10, 20, 20), image.Rect(10, 10, 20, 20)},
+		{&TentFilter{R: 1}, image.Rect(10, 10, 20, 20), image.Rect(9, 9, 21, 21)},
+		{&GaussianFilter{R: 1.5, Alpha: 2}, image.Rect(10, 10, 20, 20), image.Rect(9, 9, 21, 21)},
+		{&LanczosFilter{R: 3}, image.Rect(10, 10, 20, 20), image.Rect(7, 7, 23, 23)},
+		{&LanczosFilter{R: 3}, image.Rect(0, 1, 99, 60), image.Rect(0, 0, 100, 60)},
+		{&LanczosFilter{R: 3}, image.Rectangle{}, image.Rect(0, 0, 100, 60)},
+	}
+	for _, tt := range tests {
+		scn := &Scene{ImgWidth: 100, ImgHeight: 60, Filter: tt.filter, Crop: tt.crop}
+		if got := scn.sampled(); got != tt.want {
+			t.Errorf("%T crop %v: sampled %v, want %v", tt.filter, tt.crop, got, tt.want)
+		}
+	}
+}
+
+func TestCropMatchesFullRender(t *testing.T) {
+	render := func(extra string) *image.RGBA {
+		scn, err := ParseScene(testScene + "filter gaussian\n" + extra)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rg, _ := NewRayGunFromScene(scn, 2)
+		if err := rg.RenderContext(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return scn.Image
+	}
+	full := render("")
+	crop := image.Rect(9, 7, 21, 15)
+	part := render("crop 9 7 21 15\n")
+	for y := crop.Min.Y; y < crop.Max.Y; y++ {
+		for x := crop.Min.X; x < crop.Max.X; x++ {
+			if part.RGBAAt(x, y) != full.RGBAAt(x, y) {
+				t.Fatalf("pixel %d,%d of the crop is %v, full render %v", x, y, part.RGBAAt(x, y), full.RGBAAt(x, y))
+			}
+		}
+	}
+	if part.RGBAAt(crop.Min.X-1, crop.Min.Y) != (color.RGBA{}) {
+		t.Error("pixel outside the crop window rendered")
+	}
+}
+
+func TestHilbertIndex(t *testing.T) {
+	tests := []struct {
+		n, x, y int
+		want    int
+	}{
+		{1, 0, 0, 0},
+		{2, 0, 0, 0},
+		{2, 0, 1, 1},
+		{2, 1, 1, 2},
+		{2, 1, 0, 3},
+		{4, 0, 0, 0},
+		{4, 1, 0, 1},
+		{4, 0, 2, 4},
+		{4, 2, 2, 8},
+		{4, 3, 1, 12},
+		{4, 3, 0, 15},
+	}
+	for _, tt := range tests {
+		if got := hilbertIndex(tt.n, tt.x, tt.y); got != tt.want {
+			t.Errorf("hilbertIndex(%d, %d, %d) = %d, want %d", tt.n, tt.x, tt.y, got, tt.want)
+		}
+	}
+
+	// the curve visits every cell once, each next to the one before
+	for _, n := range []int{2, 4, 8, 16} {
+		cells := make([]image.Point, n*n)
+		seen := make([]bool, n*n)
+		for y := 0; y < n; y++ {
+			for x := 0; x < n; x++ {
+				d := hilbertIndex(n, x, y)
+				if d < 0 || d >= n*n || seen[d] {
+					t.Fatalf("n %d: cell %d,%d has index %d", n, x, y, d)
+				}
+				seen[d] = true
+				cells[d] = image.Pt(x, y)
+			}
+		}
+		for d := 1; d < n*n; d++ {
+			step := cells[d].Sub(cells[d-1])
+			if step.X*step.X+step.Y*step.Y != 1 {
+				t.Errorf("n %d: step %d from %v to %v", n, d, cells[d-1], cells[d])
+			}
+		}
+	}
+}
+
+func TestTilesCoverRegion(t *testing.T) {
+	for _, order := range []string{"row", "spiral", "hilbert"} {
+		for _, crop := range []image.Rectangle{{}, image.Rect(10, 5, 90, 47)} {
+			scn := &Scene{ImgWidth: 100, ImgHeight: 60, TileSize: 16, TileOrder: order, Crop: crop}
+			area := scn.Region()
+			count := make(map[image.Point]int)
+			for _, tile := range scn.Tiles() {
+				if !tile.In(area) {
+					t.Errorf("%s %v: tile %v outside %v", order, crop, tile, area)
+				}
+				for y := tile.Min.Y; y < tile.Max.Y; y++ {
+					for x := tile.Min.X; x < tile.Max.X; x++ {
+						count[image.Pt(x, y)]++
+					}
+				}
+			}
+			for p, c := range count {
+				if c != 1 {
+					t.Errorf("%s %v: pixel %v in %d tiles", order, crop, p, c)
+				}
+			}
+			if len(count) != area.Dx()*area.Dy() {
+				t.Errorf("%s %v: %d pixels in tiles, want %d", order, crop, len(count), area.Dx()*area.Dy())
+			}
+		}
+	}
+}